@@ -2,21 +2,112 @@ package main
 
 import (
     "bufio"
-    "encoding/json"
+    "cmp"
     "fmt"
-    "net"
+    "io"
     "os"
+    "path/filepath"
+    "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
     "time"
+    "unicode"
+
+    "messenger/core"
 )
 
 const (
-    clearScreen = "\033[H\033[2J"
-    clearLine   = "\033[2K"
-    moveUp      = "\033[1A"
-    moveToStart = "\033[0G"
+    clearScreen     = "\033[H\033[2J"
+    clearLine       = "\033[2K"
+    clearScrollback = "\033[3J"
+    moveUp          = "\033[1A"
+    moveToStart     = "\033[0G"
+    colorAlert      = "\033[1;97;41m" // bold white on red
+    colorReset      = "\033[0m"
+    bell            = "\a"
+
+    linePrompt = "Enter command: "
 )
 
+// commandNames are completed at the start of the input line.
+var commandNames = []string{
+    "help", "list", "send", "file", "connect", "receipts", "reply", "edit",
+    "retract", "history", "alert", "ack", "presence", "status", "quit",
+}
+
+// out receives command output: the terminal in line mode, the message
+// pane in full-screen mode. It is switched while event and control
+// goroutines write to it.
+var out = &switchWriter{w: os.Stdout}
+
+// switchWriter writes to a writer that may be replaced at any time.
+type switchWriter struct {
+    mu sync.RWMutex
+    w  io.Writer
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.w.Write(p)
+}
+
+// set sends further output to w.
+func (s *switchWriter) set(w io.Writer) {
+    s.mu.Lock()
+    s.w = w
+    s.mu.Unlock()
+}
+
+// running is cleared when the user quits, stopping background updates.
+var running atomic.Bool
+
+// events receives notifications instead of the prompt in line mode when
+// a subcommand runs without one: stdout for listen, discarded otherwise.
+var events io.Writer
+
+// notify shows an event that can arrive while the user is typing, such as
+// an incoming message, without clobbering their input.
+func notify(format string, args ...interface{}) {
+    text := fmt.Sprintf(format, args...)
+    if t := screen.Load(); t != nil {
+        t.addLine(text, false)
+        return
+    }
+    if events != nil {
+        fmt.Fprintln(events, text)
+        return
+    }
+    fmt.Printf("\n%s%s%s\n%s", clearLine, text, moveToStart, promptLine())
+}
+
+// promptLine redraws the line-mode prompt, with any partly typed command.
+func promptLine() string {
+    if e := lineInput.Load(); e != nil {
+        return e.render(linePrompt)
+    }
+    return linePrompt
+}
+
+// notifyAlert is notify for priority alerts: highlighted, with a bell.
+func notifyAlert(format string, args ...interface{}) {
+    text := fmt.Sprintf(format, args...)
+    if t := screen.Load(); t != nil {
+        t.addLine(text, true)
+        return
+    }
+    if events != nil {
+        fmt.Fprintln(events, text)
+        return
+    }
+    fmt.Printf("\n%s%s", clearLine, bell)
+    for _, line := range strings.Split(text, "\n") {
+        fmt.Printf("%s %s %s\n", colorAlert, line, colorReset)
+    }
+    fmt.Print(moveToStart + promptLine())
+}
+
 func showSplashScreen() {
     splash := `
     ███╗   ██╗ █████╗ ███████╗ ██████╗     ██████╗  █████╗ ██████╗ ██╗ ██████╗ 
@@ -60,21 +151,85 @@ func validateCommand(input string) error {
         }
     }
 
+    if input == "connect" || strings.HasPrefix(input, "connect ") {
+        if strings.TrimSpace(strings.TrimPrefix(input, "connect")) == "" {
+            return fmt.Errorf("no peer address provided")
+        }
+    }
+
+    for _, command := range []string{"reply", "edit"} {
+        if input == command || strings.HasPrefix(input, command+" ") {
+            if len(strings.Fields(input)) < 3 {
+                return fmt.Errorf("usage: %s <msg-id> <message>", command)
+            }
+        }
+    }
+
+    if input == "retract" {
+        return fmt.Errorf("usage: retract <msg-id>")
+    }
+
+    if input == "alert" || (strings.HasPrefix(input, "alert ") && strings.TrimSpace(input[6:]) == "") {
+        return fmt.Errorf("empty alert")
+    }
+
     return nil
 }
 
-func startCLI(messenger *Messenger) {
+// startCLI runs the interactive interface until the user quits. The user
+// is shown as away after idle without input, unless idle is 0.
+func startCLI(messenger *core.Messenger, fullScreen bool, historyFile string, idle time.Duration) {
+    running.Store(true)
+    editor := newLineEditor(historyFile, completeInput(messenger))
+
+    // Switch to away when the user stops typing
+    var lastInput atomic.Int64
+    lastInput.Store(time.Now().UnixNano())
+    onInput := func() {
+        lastInput.Store(time.Now().UnixNano())
+        messenger.CheckIdle(time.Now(), idle)
+    }
+    go func() {
+        ticker := time.NewTicker(15 * time.Second)
+        for range ticker.C {
+            if !running.Load() {
+                return
+            }
+            messenger.CheckIdle(time.Unix(0, lastInput.Load()), idle)
+        }
+    }()
+
+    if jsonOutput {
+        runJSONCommands(messenger, onInput)
+        return
+    }
+
+    if fullScreen {
+        err := runTUI(messenger, editor, onInput)
+        if err == nil {
+            fmt.Println("Shutting down...")
+            running.Store(false)
+            return
+        }
+        fmt.Printf("Full-screen mode unavailable (%v), using line mode\n", err)
+    }
+
     showSplashScreen()
     fmt.Printf("Your ID: %s\n\n", messenger.ID)
 
     // Reserve a line for status
-    fmt.Println(messenger.getNetworkStatus())
+    fmt.Println(getStatusLine(messenger))
     
-    // Start status updater in background
+    // Start status updater in background, also woken when someone starts
+    // or stops typing
     go func() {
         ticker := time.NewTicker(5 * time.Second)
-        for range ticker.C {
-            if !messenger.running {
+        for {
+            select {
+            case <-ticker.C:
+            case <-statusChanged:
+            }
+            if !running.Load() {
                 return
             }
             // Move up one line, clear it, and write new status
@@ -82,217 +237,503 @@ func startCLI(messenger *Messenger) {
                 moveUp,
                 clearLine,
                 moveToStart,
-                messenger.getNetworkStatus())
+                getStatusLine(messenger))
+            if lineInput.Load() != nil {
+                fmt.Print(promptLine())
+            }
         }
     }()
 
     fmt.Println("\nEnter command (type 'help' for available commands):")
+    defer running.Store(false)
     
     scanner := bufio.NewScanner(os.Stdin)
-    messenger.running = true
+    readLine := func() (string, error) {
+        if !scanner.Scan() {
+            return "", io.EOF
+        }
+        onInput()
+        return scanner.Text(), nil
+    }
+
+    // On a terminal, edit lines in place with history and completion
+    if isTerminal(int(os.Stdin.Fd())) {
+        if restore, err := makeInputRaw(int(os.Stdin.Fd())); err == nil {
+            defer restore()
+            lineInput.Store(editor)
+            defer lineInput.Store(nil)
+
+            in := bufio.NewReader(os.Stdin)
+            onKey := func(k key) {
+                onInput()
+                if k.code == keyRune && composingMessage(editor.line()) {
+                    messenger.NotifyTyping()
+                }
+            }
+            readLine = func() (string, error) {
+                return editor.readLine(in, linePrompt, onKey)
+            }
+        }
+    }
     
-    for scanner.Scan() {
-        input := scanner.Text()
+    for {
+        input, err := readLine()
+        if err == errInterrupted {
+            fmt.Println("Shutting down...")
+            return
+        }
+        if err != nil {
+            return
+        }
+
+        // Anything printed before the user pressed Enter has been seen
+        messenger.MarkAllRead()
         
         // Validate input
         if err := validateCommand(input); err != nil {
             fmt.Printf("Error: %v\n", err)
-            fmt.Print("\nEnter command: ")
+            fmt.Print("\n" + linePrompt)
             continue
         }
 
         // Clear the input line after command
         fmt.Print(clearLine + moveToStart)
-        
-        switch {
-        case input == "help":
-            printHelp()
-        
-        case input == "list":
-            listPeers(messenger)
-        
-        case input == "status":
-            handleStatusCommand(messenger)
-        
-        case input == "quit":
+
+        if !runCommand(messenger, input) {
             fmt.Println("Shutting down...")
-            messenger.running = false
             return
-        
-        case strings.HasPrefix(input, "send "):
-            handleSendCommand(messenger, input[5:])
-        
-        case strings.HasPrefix(input, "file "):
-            handleFileCommand(messenger, input[5:])
         }
         
-        fmt.Print("\nEnter command: ")
+        fmt.Print("\n" + linePrompt)
     }
 }
 
-func printHelp() {
-    fmt.Println("\nAvailable commands:")
-    fmt.Println("  help           - Show this help")
-    fmt.Println("  list           - List connected peers")
-    fmt.Println("  send <message> - Send text message")
-    fmt.Println("  file <path>    - Send file")
-    fmt.Println("  status         - Show network and statistics")
-    fmt.Println("  quit           - Exit the application")
-    fmt.Println()
-}
-
-func listPeers(messenger *Messenger) {
-    fmt.Println("\nConnected peers:")
-    messenger.peersMutex.RLock()
-    defer messenger.peersMutex.RUnlock()
+// runCommand executes one validated command line, writing its output to
+// out. It returns false when the user asked to quit.
+func runCommand(messenger *core.Messenger, input string) bool {
+    switch {
+    case input == "help":
+        printHelp()
     
-    for _, peer := range messenger.peers {
-        fmt.Printf("  %s (%s) - Last seen: %s\n", 
-            peer.ID, peer.Address, peer.LastSeen.Format("15:04:05"))
-    }
-    fmt.Println()
-}
-
-func handleSendCommand(messenger *Messenger, message string) {
-    // Create message
-    msg := Message{
-        Type:      "text",
-        Content:   message,
-        Timestamp: time.Now(),
-        SenderID:  messenger.ID,
-        Size:      int64(len(message)),
-    }
-
-    // Broadcast to all peers except self
-    messenger.peersMutex.RLock()
-    peerCount := 0
-    for _, peer := range messenger.peers {
-        if peer.ID != messenger.ID {
-            // Send message to peer
-            if err := messenger.sendToPeer(peer, msg); err != nil {
-                fmt.Printf("\nError sending to %s: %v\n", peer.ID, err)
-                continue
-            }
-            peerCount++
+    case input == "list":
+        listPeers(messenger)
+    
+    case input == "status":
+        handleStatusCommand(messenger)
+    
+    case input == "quit":
+        return false
+    
+    case strings.HasPrefix(input, "send "):
+        handleSendCommand(messenger, input[5:])
+    
+    case strings.HasPrefix(input, "file "):
+        handleFileCommand(messenger, input[5:])
+
+    case strings.HasPrefix(input, "connect "):
+        handleConnectCommand(messenger, strings.TrimSpace(input[8:]))
+
+    case input == "receipts" || strings.HasPrefix(input, "receipts "):
+        handleReceiptsCommand(messenger, strings.TrimSpace(strings.TrimPrefix(input, "receipts")))
+
+    case strings.HasPrefix(input, "reply "):
+        handleReplyCommand(messenger, input[6:])
+
+    case strings.HasPrefix(input, "edit "):
+        handleEditCommand(messenger, "edit", input[5:])
+
+    case strings.HasPrefix(input, "retract "):
+        handleEditCommand(messenger, "retract", input[8:])
+
+    case strings.HasPrefix(input, "alert "):
+        handleAlertCommand(messenger, strings.TrimSpace(input[6:]))
+
+    case input == "ack" || strings.HasPrefix(input, "ack "):
+        handleAckCommand(messenger, strings.TrimSpace(strings.TrimPrefix(input, "ack")))
+
+    case input == "presence" || strings.HasPrefix(input, "presence "):
+        handlePresenceCommand(messenger, strings.TrimSpace(strings.TrimPrefix(input, "presence")))
+
+    case input == "history" || strings.HasPrefix(input, "history "):
+        handleHistoryCommand(messenger, strings.TrimSpace(strings.TrimPrefix(input, "history")))
+    }
+    return true
+}
+
+// completeInput completes command names at the start of the line, paths
+// after "file", and peer IDs and nicknames anywhere else.
+func completeInput(messenger *core.Messenger) completer {
+    return func(line string, pos int) (int, []string) {
+        before := []rune(line)[:pos]
+        command, arg, found := strings.Cut(string(before), " ")
+        if !found {
+            return 0, withPrefix(commandNames, command)
+        }
+        if command == "file" {
+            return len([]rune(command)) + 1, completePath(arg)
+        }
+
+        start := pos
+        for start > 0 && before[start-1] != ' ' {
+            start--
         }
+        return start, withPrefix(peerNames(messenger), string(before[start:]))
     }
-    messenger.peersMutex.RUnlock()
+}
 
-    if peerCount == 0 {
-        // No peers available, queue the message
-        messenger.queueMessage(msg)
-        fmt.Printf("\n%sNo peers available. Message queued for retry%s\n\nEnter command: ",
-            clearLine, moveToStart)
-        return
+// completePath lists files and directories starting with prefix.
+// Directories end in "/" so completion can continue into them.
+func completePath(prefix string) []string {
+    dir, base := filepath.Split(prefix)
+    entries, err := os.ReadDir(cmp.Or(dir, "."))
+    if err != nil {
+        return nil
     }
 
-    // Update statistics
-    messenger.updateStats(msg, true)
+    var matches []string
+    for _, entry := range entries {
+        name := entry.Name()
+        if !strings.HasPrefix(name, base) {
+            continue
+        }
+        // Hidden files only when asked for
+        if strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+            continue
+        }
+        if entry.IsDir() {
+            name += "/"
+        }
+        matches = append(matches, dir+name)
+    }
+    return matches
+}
+
+func withPrefix(words []string, prefix string) []string {
+    var matches []string
+    for _, w := range words {
+        if strings.HasPrefix(w, prefix) {
+            matches = append(matches, w)
+        }
+    }
+    return matches
+}
 
-    // Clear line and show status
-    fmt.Printf("\n%sMessage sent to %d peers%s\n\nEnter command: ", 
-        clearLine, peerCount, moveToStart)
+func printHelp() {
+    fmt.Fprintln(out, "\nAvailable commands:")
+    fmt.Fprintln(out, "  help                - Show this help")
+    fmt.Fprintln(out, "  list                - List connected peers")
+    fmt.Fprintln(out, "  send <message>      - Send text message")
+    fmt.Fprintln(out, "  send --ttl 5m <msg> - Send a message receivers discard after 5 minutes")
+    fmt.Fprintln(out, "  file <path>         - Send file")
+    fmt.Fprintln(out, "  connect <host:port> - Add a static peer and probe it")
+    fmt.Fprintln(out, "  receipts [msg-id]   - Show who received and read a sent message")
+    fmt.Fprintln(out, "  reply <id> <text>   - Reply to a message")
+    fmt.Fprintln(out, "  edit <id> <text>    - Replace the text of a message you sent")
+    fmt.Fprintln(out, "  retract <id>        - Withdraw a message you sent")
+    fmt.Fprintln(out, "  history [n]         - Show the last n messages (default 20)")
+    fmt.Fprintln(out, "  alert <message>     - Send a priority alert every peer must acknowledge")
+    fmt.Fprintln(out, "  ack [id|all]        - Acknowledge received alerts (lists them without id)")
+    fmt.Fprintln(out, "  presence [status]   - Show or set status: available, busy, away,")
+    fmt.Fprintln(out, "                        offline-soon (each with optional note) or any text")
+    fmt.Fprintln(out, "  status              - Show network and statistics")
+    fmt.Fprintln(out, "  quit                - Exit the application")
+    fmt.Fprintln(out, "\nTab completes commands, peers and file paths; Up/Down recall history.")
+    fmt.Fprintln(out)
 }
 
-func handleFileCommand(messenger *Messenger, filepath string) {
-    // Check if file exists and memory is sufficient
-    if err := messenger.handleLargeFile(filepath); err != nil {
-        fmt.Printf("Error: %v\n", err)
+func listPeers(messenger *core.Messenger) {
+    if jsonOutput {
+        emit(peersEvent{header("peers"), messenger.Peers()})
         return
     }
+    fmt.Fprintln(out, "\nConnected peers:")
+    for _, addr := range messenger.PendingPeers() {
+        fmt.Fprintf(out, "  %s - static, waiting for reply\n", addr)
+    }
+    for _, peer := range messenger.Peers() {
+        static := ""
+        if peer.Static {
+            static = " [static]"
+        }
+        if peer.Via != "" {
+            static += fmt.Sprintf(" [via %s]", peer.Via)
+        }
+        if peer.Interface != "" {
+            static += " on " + peer.Interface
+        }
+        if peer.Version != "" {
+            static += fmt.Sprintf(" v%s", peer.Version)
+        }
+        if peer.Presence != "" {
+            static += fmt.Sprintf(" [%s]", formatPresence(peer.Presence, peer.PresenceText))
+        }
+        if !peer.Compatible {
+            static += " [incompatible]"
+        }
+        name := peer.ID
+        if peer.Nickname != "" {
+            name += fmt.Sprintf(" %q", peer.Nickname)
+        }
+        fmt.Fprintf(out, "  %s (%s)%s - Last seen: %s\n", 
+            name, peer.Address, static, peer.LastSeen.Format("15:04:05"))
+    }
+    fmt.Fprintln(out)
+}
 
-    // Read file
-    data, err := os.ReadFile(filepath)
+func handlePresenceCommand(messenger *core.Messenger, status string) {
+    if status != "" {
+        messenger.SetPresence(core.ParsePresence(status))
+    }
+    fmt.Fprintf(out, "Your status: %s\n", presenceStatus(messenger))
+}
+
+func handleConnectCommand(messenger *core.Messenger, hostport string) {
+    addr, err := messenger.Connect(hostport)
     if err != nil {
-        fmt.Printf("Error reading file: %v\n", err)
+        fmt.Fprintf(out, "Error: %v\n", err)
         return
     }
+    fmt.Fprintf(out, "Probing %s, it will appear in 'list' once it answers\n", addr)
+}
 
-    // Create message
-    msg := Message{
-        Type:      "file",
-        Content:   filepath,
-        Data:      data,
-        Timestamp: time.Now(),
-        SenderID:  messenger.ID,
-        Size:      int64(len(data)),
-    }
-
-    // Broadcast to all peers except self
-    messenger.peersMutex.RLock()
-    peerCount := 0
-    for _, peer := range messenger.peers {
-        if peer.ID != messenger.ID {
-            fmt.Printf("Sending file to peer %s...\n", peer.ID)
-            if err := messenger.sendToPeer(peer, msg); err != nil {
-                fmt.Printf("Error sending to %s: %v\n", peer.ID, err)
-                continue
-            }
-            peerCount++
-        }
+func handleSendCommand(messenger *core.Messenger, message string) {
+    ttl, message, err := parseTTL(message)
+    if err != nil {
+        fmt.Fprintf(out, "Error: %v\n", err)
+        return
     }
-    messenger.peersMutex.RUnlock()
+    sendTextMessage(messenger, message, "", ttl)
+}
 
-    if peerCount == 0 {
-        // No peers available, queue the message
-        messenger.queueMessage(msg)
-        fmt.Printf("\n%sNo peers available. File queued for retry%s\n\nEnter command: ",
-            clearLine, moveToStart)
-        return
+// parseTTL strips a leading "--ttl <duration>" or "--ttl=<duration>"
+// option from the arguments of send.
+func parseTTL(args string) (time.Duration, string, error) {
+    if !strings.HasPrefix(args, "--ttl") {
+        return 0, args, nil
     }
 
-    messenger.updateStats(msg, true)
-    fmt.Printf("\n%sFile sent to %d peers%s\n\nEnter command: ", 
-        clearLine, peerCount, moveToStart)
+    rest := strings.TrimPrefix(args, "--ttl")
+    var value string
+    if strings.HasPrefix(rest, "=") {
+        value, rest, _ = strings.Cut(rest[1:], " ")
+    } else {
+        fields := strings.SplitN(strings.TrimSpace(rest), " ", 2)
+        value, rest = fields[0], ""
+        if len(fields) == 2 {
+            rest = fields[1]
+        }
+    }
+
+    ttl, err := time.ParseDuration(value)
+    if err != nil || ttl <= 0 {
+        return 0, "", fmt.Errorf("invalid TTL %q, use e.g. --ttl 5m", value)
+    }
+    rest = strings.TrimSpace(rest)
+    if rest == "" {
+        return 0, "", fmt.Errorf("empty message")
+    }
+    return ttl, rest, nil
 }
 
-func handleStatusCommand(messenger *Messenger) {
-    fmt.Print(clearScreen)  // Clear screen before showing full status
-    fmt.Println("=== Status Report ===")
-    fmt.Println(messenger.getNetworkStatus())
-    fmt.Println(messenger.getStatistics())
-    fmt.Println("Encryption: Enabled (AES-GCM)")
-    fmt.Println("=====================================")
-    fmt.Print("\nPress Enter to continue...")
-    bufio.NewReader(os.Stdin).ReadString('\n')
-    
-    // Redraw the normal interface
-    fmt.Print(clearScreen)
+// clearExpiredFromScreen wipes the terminal, including its scrollback, so
+// expired messages no longer appear anywhere, then redraws the prompt. In
+// full-screen mode only the message pane is cleared, and with -json the
+// expired event tells the consumer instead.
+func clearExpiredFromScreen(messenger *core.Messenger) {
+    const note = "Expired messages were cleared. Use 'history' to see the remaining ones."
+    if jsonOutput {
+        return
+    }
+    if t := screen.Load(); t != nil {
+        t.clear()
+        t.addLine(note, false)
+        return
+    }
+    fmt.Print(clearScrollback + clearScreen)
     showSplashScreen()
     fmt.Printf("Your ID: %s\n\n", messenger.ID)
-    fmt.Println(messenger.getNetworkStatus())
+    fmt.Println(getNetworkStatus(messenger))
+    fmt.Println("\n" + note)
     fmt.Print("\nEnter command: ")
 }
 
-func (m *Messenger) sendToPeer(peer *Peer, msg Message) error {
-    // Encrypt the message
-    data, err := json.Marshal(msg)
+// splitArg splits args at the first run of whitespace into a message ID
+// and the text after it, which is "" if there is none.
+func splitArg(args string) (string, string) {
+    args = strings.TrimSpace(args)
+    if i := strings.IndexFunc(args, unicode.IsSpace); i >= 0 {
+        return args[:i], strings.TrimSpace(args[i:])
+    }
+    return args, ""
+}
+
+func handleReplyCommand(messenger *core.Messenger, args string) {
+    id, text := splitArg(args)
+    if text == "" {
+        fmt.Fprintln(out, "Error: usage: reply <msg-id> <message>")
+        return
+    }
+    replyTo, err := messenger.ResolveMessageID(id)
     if err != nil {
-        return fmt.Errorf("failed to marshal message: %v", err)
+        fmt.Fprintf(out, "Error: %v\n", err)
+        return
     }
+    sendTextMessage(messenger, text, replyTo, 0)
+}
 
-    encrypted, err := m.encrypt(data)
+// sendTextMessage sends a text, optionally as a reply to message replyTo
+// and discarded by receivers after ttl if it is not zero.
+func sendTextMessage(messenger *core.Messenger, message, replyTo string, ttl time.Duration) {
+    result, err := messenger.Send(message, core.SendOptions{ReplyTo: replyTo, TTL: ttl})
     if err != nil {
-        return fmt.Errorf("failed to encrypt message: %v", err)
+        fmt.Fprintf(out, "Error: %v\n", err)
+        return
     }
+    printSendErrors(result)
+    emit(sentEvent{header("sent"), result.ID, result.Type, result.Recipients, result.Queued})
+    if result.Queued {
+        fmt.Fprintf(out, "No peers available. Message %s queued for retry\n", result.ID)
+        return
+    }
+    fmt.Fprintf(out, "Message %s sent to %d peers\n", result.ID, result.Recipients)
+}
 
-    // Create UDP connection to peer
-    addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", peer.Address, messagePort))
+func handleFileCommand(messenger *core.Messenger, filepath string) {
+    result, err := messenger.SendFile(filepath, core.SendOptions{})
     if err != nil {
-        return fmt.Errorf("failed to resolve peer address: %v", err)
+        fmt.Fprintf(out, "Error: %v\n", err)
+        return
+    }
+    printSendErrors(result)
+    emit(sentEvent{header("sent"), result.ID, result.Type, result.Recipients, result.Queued})
+    if result.Queued {
+        fmt.Fprintf(out, "No peers available. File queued for retry\n")
+        return
     }
+    fmt.Fprintf(out, "File %s sent to %d peers\n", result.ID, result.Recipients)
+}
 
-    conn, err := net.DialUDP("udp", nil, addr)
+// handleAlertCommand sends a priority message. It stays at the front of the
+// retry queue until every active peer has confirmed delivery.
+func handleAlertCommand(messenger *core.Messenger, message string) {
+    result, err := messenger.Send(message, core.SendOptions{Alert: true})
     if err != nil {
-        return fmt.Errorf("failed to connect to peer: %v", err)
+        fmt.Fprintf(out, "Error: %v\n", err)
+        return
+    }
+    printSendErrors(result)
+    emit(sentEvent{header("sent"), result.ID, "alert", result.Recipients, false})
+    fmt.Fprintf(out, "Alert %s sent to %d peers, retrying until delivered. "+
+        "Use 'receipts %s' to see acknowledgements\n", result.ID, result.Recipients, shortID(result.ID))
+}
+
+// printSendErrors reports the peers a message could not be sent to.
+func printSendErrors(result core.SendResult) {
+    for _, failure := range result.Failed {
+        fmt.Fprintf(out, "Error sending to %s: %v\n", failure.PeerID, failure.Err)
     }
-    defer conn.Close()
+}
 
-    // Send the encrypted message
-    _, err = conn.Write(encrypted)
+func handleAckCommand(messenger *core.Messenger, id string) {
+    if id == "" {
+        pending := messenger.PendingAlerts()
+        if len(pending) == 0 {
+            fmt.Fprintln(out, "No alerts waiting for acknowledgement")
+            return
+        }
+        fmt.Fprintln(out, "Alerts waiting for acknowledgement:")
+        for _, alert := range pending {
+            fmt.Fprintf(out, "  [%s] %s %s: %s\n", shortID(alert.ID),
+                alert.Timestamp.Format("15:04:05"), alert.SenderID, alert.Content)
+        }
+        return
+    }
+
+    acked := messenger.AcknowledgeAlerts(id)
+    if len(acked) == 0 {
+        fmt.Fprintf(out, "Error: no pending alert with ID %s\n", id)
+        return
+    }
+    fmt.Fprintf(out, "Acknowledged %d alert(s)\n", len(acked))
+}
+
+// handleEditCommand sends a signed edit or retraction of one of our own
+// messages. kind is "edit" or "retract".
+func handleEditCommand(messenger *core.Messenger, kind, args string) {
+    id, text := splitArg(args)
+    var result core.SendResult
+    var err error
+    if kind == "edit" {
+        if text == "" {
+            fmt.Fprintln(out, "Error: usage: edit <msg-id> <message>")
+            return
+        }
+        result, err = messenger.Edit(id, text)
+    } else {
+        result, err = messenger.Retract(id)
+    }
     if err != nil {
-        return fmt.Errorf("failed to send message: %v", err)
+        fmt.Fprintf(out, "Error: %v\n", err)
+        return
     }
 
-    return nil
-} 
\ No newline at end of file
+    printSendErrors(result)
+    if result.Queued {
+        fmt.Fprintf(out, "No peers available. %s of [%s] queued for retry\n", kind, shortID(result.ID))
+        return
+    }
+    fmt.Fprintf(out, "Sent %s of [%s] to %d peers\n", kind, shortID(result.ID), result.Recipients)
+}
+
+func handleHistoryCommand(messenger *core.Messenger, arg string) {
+    n := 20
+    if arg != "" {
+        var err error
+        if n, err = strconv.Atoi(arg); err != nil || n <= 0 {
+            fmt.Fprintf(out, "Error: invalid count: %s\n", arg)
+            return
+        }
+    }
+    fmt.Fprintln(out, formatHistory(messenger, n))
+}
+
+func handleReceiptsCommand(messenger *core.Messenger, id string) {
+    report, err := formatReceipts(messenger, id)
+    if err != nil {
+        fmt.Fprintf(out, "Error: %v\n", err)
+        return
+    }
+    fmt.Fprintln(out, report)
+}
+
+func handleStatusCommand(messenger *core.Messenger) {
+    if jsonOutput {
+        emit(newStatsEvent(messenger))
+        return
+    }
+
+    // The full-screen interface shows the report in the message pane
+    fullScreen := screen.Load() != nil
+    if !fullScreen {
+        fmt.Print(clearScreen)  // Clear screen before showing full status
+    }
+    fmt.Fprintln(out, "=== Status Report ===")
+    fmt.Fprintf(out, "Your status: %s\n", presenceStatus(messenger))
+    fmt.Fprintln(out, getNetworkStatus(messenger))
+    fmt.Fprintln(out, formatInterfaces(messenger))
+    fmt.Fprintln(out, messenger.Stats())
+    fmt.Fprintln(out, "Encryption: Enabled (AES-GCM)")
+    fmt.Fprintln(out, "=====================================")
+    if fullScreen {
+        return
+    }
+    fmt.Print("\nPress Enter to continue...")
+    bufio.NewReader(os.Stdin).ReadString('\n')
+    
+    // Redraw the normal interface
+    fmt.Print(clearScreen)
+    showSplashScreen()
+    fmt.Printf("Your ID: %s\n\n", messenger.ID)
+    fmt.Println(getNetworkStatus(messenger))
+}
+
@@ -0,0 +1,424 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "messenger/core"
+)
+
+const (
+    maxSubscriberBacklog = 256       // events a subscriber may fall behind before it is dropped
+    maxControlLine       = 64 * 1024 // longest request or answer line
+)
+
+// The control socket lets scripts and other frontends use a running node
+// instead of starting their own. Each request is one line of JSON and is
+// answered with one event line, as written by -json:
+//
+//   {"command":"send","text":"hi","to":"alice","ttl":"5m","timeout":"10s"} -> delivery
+//   {"command":"send","text":"yes","replyTo":"c6711bc9"}                  -> delivery
+//   {"command":"file","path":"/abs/path","to":"alice"}                    -> delivery
+//   {"command":"list"}                                                    -> peers
+//   {"command":"status"}                                                  -> stats
+//   {"command":"subscribe"}                  -> subscribed, then every event
+//
+// Failed requests are answered with an error event.
+type controlRequest struct {
+    Command string `json:"command"`
+    Text    string `json:"text,omitempty"`
+    Path    string `json:"path,omitempty"`
+    To      string `json:"to,omitempty"`
+    ReplyTo string `json:"replyTo,omitempty"`
+    TTL     string `json:"ttl,omitempty"`
+    Timeout string `json:"timeout,omitempty"`
+}
+
+// errorEvent answers a control request that failed.
+type errorEvent struct {
+    eventHeader
+    Error string `json:"error"`
+}
+
+// controlReply is any answer or event read from the control socket.
+type controlReply struct {
+    Event      string     `json:"event"`
+    Error      string     `json:"error"`
+    ID         string     `json:"id"`
+    Type       string     `json:"type"`
+    From       string     `json:"from"`
+    Content    string     `json:"content"`
+    Path       string     `json:"path"`
+    Alert      bool       `json:"alert"`
+    Delivered  int        `json:"delivered"`
+    Recipients int        `json:"recipients"`
+    Problems   []string   `json:"problems"`
+    Peers      []core.PeerInfo `json:"peers"`
+}
+
+// subscribers receive every event as a line of JSON.
+var subscribers = struct {
+    sync.Mutex
+    chans map[chan []byte]bool
+}{chans: make(map[chan []byte]bool)}
+
+// defaultControlSocket is where a node listens for local clients unless
+// -control names another path.
+func defaultControlSocket() string {
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(home, ".messenger.sock")
+}
+
+func subscribe() chan []byte {
+    ch := make(chan []byte, maxSubscriberBacklog)
+    subscribers.Lock()
+    subscribers.chans[ch] = true
+    subscribers.Unlock()
+    return ch
+}
+
+func unsubscribe(ch chan []byte) {
+    subscribers.Lock()
+    defer subscribers.Unlock()
+    if subscribers.chans[ch] {
+        delete(subscribers.chans, ch)
+        close(ch)
+    }
+}
+
+func hasSubscribers() bool {
+    subscribers.Lock()
+    defer subscribers.Unlock()
+    return len(subscribers.chans) > 0
+}
+
+// publish hands an encoded event to the subscribers. One that has fallen
+// too far behind is dropped rather than slowing down the node.
+func publish(line []byte) {
+    subscribers.Lock()
+    defer subscribers.Unlock()
+    for ch := range subscribers.chans {
+        select {
+        case ch <- line:
+        default:
+            delete(subscribers.chans, ch)
+            close(ch)
+        }
+    }
+}
+
+// startControl listens for local clients on the Unix socket at path, and
+// returns a function that stops listening and removes the socket.
+func startControl(m *core.Messenger, path string) (func(), error) {
+    if conn, err := net.Dial("unix", path); err == nil {
+        conn.Close()
+        return nil, fmt.Errorf("another node is listening on %s", path)
+    }
+    // Left behind by a node that did not shut down cleanly. Anything else
+    // at path, such as a mistyped file name, is left alone.
+    if info, err := os.Lstat(path); err == nil {
+        if info.Mode()&os.ModeSocket == 0 {
+            return nil, fmt.Errorf("%s exists and is not a socket", path)
+        }
+        if err := os.Remove(path); err != nil {
+            return nil, err
+        }
+    }
+
+    ln, err := net.Listen("unix", path)
+    if err != nil {
+        return nil, err
+    }
+    if err := os.Chmod(path, 0600); err != nil {
+        ln.Close()
+        return nil, err
+    }
+
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go serveControl(m, conn)
+        }
+    }()
+    return func() { ln.Close() }, nil
+}
+
+// serveControl answers the requests of one client until it disconnects or
+// subscribes.
+func serveControl(m *core.Messenger, conn net.Conn) {
+    defer conn.Close()
+    enc := json.NewEncoder(conn)
+    scanner := bufio.NewScanner(conn)
+    for scanner.Scan() {
+        var req controlRequest
+        if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+            enc.Encode(errorEvent{header("error"), fmt.Sprintf("invalid request: %v", err)})
+            continue
+        }
+
+        if req.Command == "subscribe" {
+            streamEvents(conn)
+            return
+        }
+        enc.Encode(answerControl(m, req))
+    }
+}
+
+// answerControl carries out a request other than subscribe and returns
+// the event that answers it.
+func answerControl(m *core.Messenger, req controlRequest) interface{} {
+    switch req.Command {
+    case "send", "file":
+        result, err := controlSend(m, req)
+        if err != nil {
+            return errorEvent{header("error"), err.Error()}
+        }
+        return result
+    case "list":
+        return peersEvent{header("peers"), m.Peers()}
+    case "status":
+        return newStatsEvent(m)
+    }
+    return errorEvent{header("error"), fmt.Sprintf("unknown command %q", req.Command)}
+}
+
+// controlSend sends the text or file of a request like the send and file
+// subcommands, and waits for delivery.
+func controlSend(m *core.Messenger, req controlRequest) (deliveryEvent, error) {
+    cmd := &subcommand{name: req.Command, to: req.To, timeout: 10 * time.Second}
+    if req.Command == "send" {
+        if req.Text == "" {
+            return deliveryEvent{}, fmt.Errorf("empty message")
+        }
+        cmd.args = []string{req.Text}
+    } else {
+        if !filepath.IsAbs(req.Path) {
+            return deliveryEvent{}, fmt.Errorf("path must be absolute: %q", req.Path)
+        }
+        cmd.args = []string{req.Path}
+    }
+    if req.ReplyTo != "" {
+        replyTo, err := m.ResolveMessageID(req.ReplyTo)
+        if err != nil {
+            return deliveryEvent{}, err
+        }
+        cmd.replyTo = replyTo
+    }
+    if req.TTL != "" {
+        ttl, err := time.ParseDuration(req.TTL)
+        if err != nil || ttl <= 0 {
+            return deliveryEvent{}, fmt.Errorf("invalid TTL %q", req.TTL)
+        }
+        cmd.ttl = ttl
+    }
+    if req.Timeout != "" {
+        timeout, err := time.ParseDuration(req.Timeout)
+        if err != nil || timeout <= 0 {
+            return deliveryEvent{}, fmt.Errorf("invalid timeout %q", req.Timeout)
+        }
+        cmd.timeout = timeout
+    }
+
+    result, err := cmd.deliver(m)
+    if err == nil {
+        notify("%s %s from a local client delivered to %d/%d peers",
+            result.Type, shortID(result.ID), result.Delivered, result.Recipients)
+    }
+    return result, err
+}
+
+// streamEvents writes every event to a subscribed client until it
+// disconnects.
+func streamEvents(conn net.Conn) {
+    ch := subscribe()
+    defer unsubscribe(ch)
+
+    // The client sends nothing more; reading tells us when it goes away
+    gone := make(chan struct{})
+    go func() {
+        io.Copy(io.Discard, conn)
+        close(gone)
+    }()
+
+    data, _ := json.Marshal(header("subscribed"))
+    if _, err := conn.Write(append(data, '\n')); err != nil {
+        return
+    }
+    for {
+        select {
+        case line, ok := <-ch:
+            if !ok {
+                return
+            }
+            if _, err := conn.Write(line); err != nil {
+                return
+            }
+        case <-gone:
+            return
+        }
+    }
+}
+
+// runRemote runs the subcommand through the node listening on the control
+// socket at path. It reports false if there is none, so the subcommand
+// starts its own node.
+func (cmd *subcommand) runRemote(path string) (int, bool) {
+    conn, err := net.Dial("unix", path)
+    if err != nil {
+        return 0, false
+    }
+    defer conn.Close()
+
+    req := controlRequest{Command: cmd.name, To: cmd.to}
+    switch cmd.name {
+    case "send":
+        req.Text = strings.Join(cmd.args, " ")
+        if cmd.ttl > 0 {
+            req.TTL = cmd.ttl.String()
+        }
+        req.Timeout = cmd.timeout.String()
+    case "file":
+        if req.Path, err = filepath.Abs(cmd.args[0]); err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+            return 1, true
+        }
+        req.Timeout = cmd.timeout.String()
+    case "peers":
+        req.Command = "list"
+    case "listen":
+        req.Command = "subscribe"
+    }
+    if err := json.NewEncoder(conn).Encode(req); err != nil {
+        return 0, false
+    }
+
+    scanner := bufio.NewScanner(conn)
+    scanner.Buffer(nil, maxControlLine)
+    if !scanner.Scan() {
+        fmt.Fprintf(os.Stderr, "Error: no answer from the node on %s\n", path)
+        return 1, true
+    }
+    var reply controlReply
+    if err := json.Unmarshal(scanner.Bytes(), &reply); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        return 1, true
+    }
+    if reply.Event == "error" {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", reply.Error)
+        return 1, true
+    }
+
+    switch cmd.name {
+    case "send", "file":
+        for _, problem := range reply.Problems {
+            fmt.Fprintln(os.Stderr, problem)
+        }
+        if jsonOutput {
+            fmt.Println(scanner.Text())
+        } else {
+            fmt.Printf("%s %s delivered to %d/%d peers\n",
+                reply.Type, reply.ID, reply.Delivered, reply.Recipients)
+        }
+        if reply.Delivered < reply.Recipients {
+            return 1, true
+        }
+    case "peers":
+        printPeerInfos(cmd, scanner.Text(), reply.Peers)
+    case "listen":
+        go func() {
+            interrupt := make(chan os.Signal, 1)
+            signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+            <-interrupt
+            conn.Close()
+        }()
+        fmt.Fprintf(os.Stderr, "Listening through the node on %s, interrupt to stop\n", path)
+        for scanner.Scan() {
+            if jsonOutput {
+                fmt.Println(scanner.Text())
+                continue
+            }
+            var event controlReply
+            if json.Unmarshal(scanner.Bytes(), &event) == nil {
+                if text := describeEvent(event); text != "" {
+                    fmt.Println(text)
+                }
+            }
+        }
+    }
+    return 0, true
+}
+
+// printPeerInfos prints the peers listed by a remote node.
+func printPeerInfos(cmd *subcommand, line string, peers []core.PeerInfo) {
+    switch {
+    case jsonOutput:
+        fmt.Println(line)
+        return
+    case cmd.json:
+        if peers == nil {
+            peers = []core.PeerInfo{}
+        }
+        data, _ := json.MarshalIndent(peers, "", "  ")
+        fmt.Println(string(data))
+        return
+    }
+
+    fmt.Println("\nConnected peers:")
+    for _, peer := range peers {
+        name := peer.ID
+        if peer.Nickname != "" {
+            name += fmt.Sprintf(" %q", peer.Nickname)
+        }
+        detail := ""
+        if peer.Interface != "" {
+            detail += " on " + peer.Interface
+        }
+        if peer.Version != "" {
+            detail += " v" + peer.Version
+        }
+        if peer.Presence != "" {
+            detail += fmt.Sprintf(" [%s]", formatPresence(peer.Presence, peer.PresenceText))
+        }
+        if !peer.Compatible {
+            detail += " [incompatible]"
+        }
+        fmt.Printf("  %s (%s)%s - Last seen: %s\n",
+            name, peer.Address, detail, peer.LastSeen.Local().Format("15:04:05"))
+    }
+    fmt.Println()
+}
+
+// describeEvent formats the events listen shows the way the node shows
+// them, or returns "" for other events.
+func describeEvent(e controlReply) string {
+    switch e.Event {
+    case "message":
+        if e.Alert {
+            return fmt.Sprintf("ALERT from %s [%s]: %s", e.From, shortID(e.ID), e.Content)
+        }
+        return fmt.Sprintf("Received from %s [%s]: %s", e.From, shortID(e.ID), e.Content)
+    case "file":
+        return fmt.Sprintf("Received file from %s [%s]: %s", e.From, shortID(e.ID), e.Path)
+    case "edited":
+        return fmt.Sprintf("Message [%s] from %s edited: %s", shortID(e.ID), e.From, e.Content)
+    case "retracted":
+        return fmt.Sprintf("Message [%s] from %s was retracted", shortID(e.ID), e.From)
+    }
+    return ""
+}
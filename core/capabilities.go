@@ -0,0 +1,124 @@
+package core
+
+import (
+    "fmt"
+)
+
+const (
+    protocolVersion    = 2 // wire protocol spoken by this build
+    minProtocolVersion = 1 // oldest protocol this build can talk to (JSON messages)
+    Version            = "1.0.0" // software version advertised to peers
+)
+
+// Transports and features a peer can advertise.
+const (
+    transportUDP = "udp"
+
+    featureFiles     = "files"
+    featureChannels  = "channels"
+    featureRelay     = "relay"
+    featureTyping    = "typing"
+    featureEphemeral = "ephemeral" // discards messages once their TTL passes
+)
+
+// Capabilities are advertised in every beacon so senders can adapt to each
+// peer. A zero value means the peer predates capabilities and is treated
+// as a protocol 1 node that accepts text and files over UDP.
+type Capabilities struct {
+    ProtocolVersion    int      `json:",omitempty"`
+    MinProtocolVersion int      `json:",omitempty"`
+    SoftwareVersion    string   `json:",omitempty"`
+    Transports         []string `json:",omitempty"`
+    MaxMessageSize     int64    `json:",omitempty"`
+    Features           []string `json:",omitempty"`
+    Compression        []string `json:",omitempty"` // algorithms the peer can decompress
+}
+
+// localCapabilities describes this build.
+func localCapabilities() Capabilities {
+    return Capabilities{
+        ProtocolVersion:    protocolVersion,
+        MinProtocolVersion: minProtocolVersion,
+        SoftwareVersion:    Version,
+        Transports:         []string{transportUDP},
+        MaxMessageSize:     maxFrameSize,
+        Features:           []string{featureFiles, featureTyping, featureEphemeral},
+        Compression:        []string{compressionDeflate},
+    }
+}
+
+func (c Capabilities) protocol() int {
+    if c.ProtocolVersion == 0 {
+        return 1
+    }
+    return c.ProtocolVersion
+}
+
+func (c Capabilities) hasFeature(feature string) bool {
+    if c.ProtocolVersion == 0 {
+        return feature == featureFiles
+    }
+    for _, f := range c.Features {
+        if f == feature {
+            return true
+        }
+    }
+    return false
+}
+
+func (c Capabilities) hasCompression(algorithm string) bool {
+    for _, a := range c.Compression {
+        if a == algorithm {
+            return true
+        }
+    }
+    return false
+}
+
+func (c Capabilities) hasTransport(transport string) bool {
+    if len(c.Transports) == 0 {
+        return transport == transportUDP
+    }
+    for _, t := range c.Transports {
+        if t == transport {
+            return true
+        }
+    }
+    return false
+}
+
+// compatible reports whether we and a peer with these capabilities share a
+// protocol version.
+func (c Capabilities) compatible() error {
+    if c.protocol() < minProtocolVersion {
+        return fmt.Errorf("peer speaks protocol %d, we need at least %d",
+            c.protocol(), minProtocolVersion)
+    }
+    if c.MinProtocolVersion > protocolVersion {
+        return fmt.Errorf("peer needs protocol %d or newer, we speak %d",
+            c.MinProtocolVersion, protocolVersion)
+    }
+    return nil
+}
+
+// checkSend reports whether a peer with these capabilities can receive
+// msg, encoded to size bytes.
+func (c Capabilities) checkSend(msg Message, size int) error {
+    if err := c.compatible(); err != nil {
+        return err
+    }
+    if !c.hasTransport(transportUDP) {
+        return fmt.Errorf("peer does not accept UDP")
+    }
+    if msg.Type == "file" && !c.hasFeature(featureFiles) {
+        return fmt.Errorf("peer does not accept files")
+    }
+    if msg.TTL > 0 && !c.hasFeature(featureEphemeral) {
+        return fmt.Errorf("peer would keep the ephemeral message, not sent")
+    }
+    if c.MaxMessageSize > 0 && int64(size) > c.MaxMessageSize {
+        return fmt.Errorf("message is %s, peer accepts at most %s",
+            formatBytes(int64(size)), formatBytes(c.MaxMessageSize))
+    }
+    return nil
+}
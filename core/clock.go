@@ -0,0 +1,26 @@
+package core
+
+// Lamport clock. Every message we originate carries the next tick; every
+// message we receive moves the clock past its tick. Sorting by clock then
+// gives an order consistent with causality: a reply always sorts after the
+// message it answers, however the datagrams were reordered.
+
+// nextClock advances the clock for a message we are about to send.
+func (m *Messenger) nextClock() uint64 {
+    m.clockMutex.Lock()
+    defer m.clockMutex.Unlock()
+
+    m.clock++
+    return m.clock
+}
+
+// observeClock merges the clock of a received message.
+func (m *Messenger) observeClock(clock uint64) {
+    m.clockMutex.Lock()
+    defer m.clockMutex.Unlock()
+
+    if clock > m.clock {
+        m.clock = clock
+    }
+    m.clock++
+}
@@ -0,0 +1,45 @@
+package core
+
+import (
+    "container/list"
+    "sync"
+)
+
+const seenCacheSize = 4096 // message IDs remembered for duplicate detection
+
+// seenCache remembers the most recent message IDs so retried or relayed
+// copies of a message are only handled once. The oldest ID is forgotten
+// when the cache is full.
+type seenCache struct {
+    mutex    sync.Mutex
+    ids      map[string]*list.Element
+    order    *list.List
+    capacity int
+}
+
+func newSeenCache(capacity int) *seenCache {
+    return &seenCache{
+        ids:      make(map[string]*list.Element),
+        order:    list.New(),
+        capacity: capacity,
+    }
+}
+
+// check records key and reports whether it had been seen before.
+func (c *seenCache) check(key string) bool {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    if e, ok := c.ids[key]; ok {
+        c.order.MoveToBack(e)
+        return true
+    }
+
+    c.ids[key] = c.order.PushBack(key)
+    if c.order.Len() > c.capacity {
+        oldest := c.order.Front()
+        c.order.Remove(oldest)
+        delete(c.ids, oldest.Value.(string))
+    }
+    return false
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+    "log"
+)
+
+const eventBacklog = 256 // events buffered for a slow subscriber before they are dropped
+
+// Event is something that happened on the network, delivered to every
+// subscriber. It is one of the types below.
+type Event interface {
+    event()
+}
+
+// TextReceived is a text message or alert from a peer.
+type TextReceived struct {
+    Message Message
+    Late    bool // a reply to it was delivered first
+}
+
+// FileReceived is a file from a peer, saved at Path. Message.Data is not
+// kept.
+type FileReceived struct {
+    Message Message
+    Path    string
+    Late    bool
+}
+
+// MessageEdited is a peer's change to a message it sent earlier.
+type MessageEdited struct {
+    ID       string
+    SenderID string
+    Content  string
+}
+
+// MessageRetracted is a peer withdrawing a message it sent earlier.
+type MessageRetracted struct {
+    ID       string
+    SenderID string
+}
+
+// PeerJoined is a peer heard from for the first time, or again after it
+// left, directly or through another peer.
+type PeerJoined struct {
+    Peer PeerInfo
+}
+
+// PeerLeft is a peer not heard from for peerTimeout, or if it is known
+// only through gossip, for a gossip round longer. It is announced by
+// PeerJoined again if it comes back.
+type PeerLeft struct {
+    Peer PeerInfo
+}
+
+// PeerIncompatible is a peer that appeared or upgraded to a protocol
+// version we cannot talk to.
+type PeerIncompatible struct {
+    Peer PeerInfo
+    Err  error
+}
+
+// AlertAcknowledged is a peer acknowledging an alert we sent.
+type AlertAcknowledged struct {
+    ID     string
+    PeerID string
+}
+
+// TypingChanged is a peer starting or stopping to type.
+type TypingChanged struct {
+    PeerID string
+    Typing bool
+}
+
+// DeliveryFailed is a queued message given up on: it expired, no peer took
+// it, or for an alert, not every peer confirmed it before the retries ran
+// out. Message.Data is not kept.
+type DeliveryFailed struct {
+    Message  Message
+    Attempts int
+    Err      error
+}
+
+// QueuedMessageSent is a queued message handed to at least one peer.
+type QueuedMessageSent struct {
+    Message  Message
+    Attempts int
+}
+
+// MessagesExpired reports ephemeral messages removed from the history, so
+// anything showing or storing them can drop them too.
+type MessagesExpired struct {
+    IDs []string
+}
+
+func (TextReceived) event()      {}
+func (FileReceived) event()      {}
+func (MessageEdited) event()     {}
+func (MessageRetracted) event()  {}
+func (PeerJoined) event()        {}
+func (PeerLeft) event()          {}
+func (PeerIncompatible) event()  {}
+func (DeliveryFailed) event()    {}
+func (QueuedMessageSent) event() {}
+func (AlertAcknowledged) event() {}
+func (TypingChanged) event()     {}
+func (MessagesExpired) event()   {}
+
+// Subscribe returns a new channel that receives every event from now on,
+// and a function that ends the subscription and closes the channel. Events
+// that arrive while the channel is full are dropped, so the network is
+// never held up by a slow subscriber. Close closes every subscription.
+func (m *Messenger) Subscribe() (<-chan Event, func()) {
+    ch := make(chan Event, eventBacklog)
+    m.eventsMutex.Lock()
+    defer m.eventsMutex.Unlock()
+
+    if m.subscribers == nil {
+        close(ch)
+        return ch, func() {}
+    }
+    m.subscribers[ch] = true
+    return ch, func() { m.unsubscribe(ch) }
+}
+
+func (m *Messenger) unsubscribe(ch chan Event) {
+    m.eventsMutex.Lock()
+    defer m.eventsMutex.Unlock()
+
+    if m.subscribers[ch] {
+        delete(m.subscribers, ch)
+        close(ch)
+    }
+}
+
+// Events returns a subscription shared by every caller, for programs that
+// read events in one place.
+func (m *Messenger) Events() <-chan Event {
+    m.eventsOnce.Do(func() {
+        m.events, _ = m.Subscribe()
+    })
+    return m.events
+}
+
+func (m *Messenger) publish(e Event) {
+    m.eventsMutex.Lock()
+    defer m.eventsMutex.Unlock()
+
+    for ch := range m.subscribers {
+        select {
+        case ch <- e:
+        default:
+            log.Printf("Dropping %T event for a subscriber that is not reading events", e)
+        }
+    }
+}
+
+// closeSubscriptions ends every subscription once the messenger stops.
+func (m *Messenger) closeSubscriptions() {
+    m.eventsMutex.Lock()
+    defer m.eventsMutex.Unlock()
+
+    for ch := range m.subscribers {
+        close(ch)
+    }
+    m.subscribers = nil
+}
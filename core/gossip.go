@@ -0,0 +1,210 @@
+package core
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "strconv"
+    "time"
+)
+
+const (
+    gossipInterval   = 30 * time.Second
+    gossipMaxEntries = 100
+    gossipMaxAge     = 5 * time.Minute // ignore entries whose beacon is older
+
+    // Gossip about a peer is up to a round old when it arrives
+    gossipPeerTimeout = gossipInterval + peerTimeout
+)
+
+// peerExchange is sent on the discovery port to share known peers with
+// neighbours that may not hear each other's broadcasts.
+type peerExchange struct {
+    Type     string        `json:"type"` // always "pex"
+    SenderID string        `json:"sender_id"`
+    Peers    []gossipEntry `json:"peers"`
+}
+
+// gossipEntry carries a peer's own signed beacon fields, including the
+// endpoint it signed, which must match Address and Port. LastSeen is only
+// the sender's word, so receivers go by SignedAt instead.
+type gossipEntry struct {
+    ID                string    `json:"id"`
+    Address           string    `json:"address"`
+    Port              int       `json:"port"`
+    MessagePort       int       `json:"message_port"`
+    LastSeen          time.Time `json:"last_seen"`
+    PublicKey         []byte    `json:"public_key"`
+    SignedAt          time.Time `json:"signed_at"`
+    Signature         []byte    `json:"signature"`
+    Endpoint          string    `json:"endpoint"`
+    EndpointSignature []byte    `json:"endpoint_signature"`
+}
+
+func (m *Messenger) gossipLoop(conn *net.UDPConn) {
+    ticker := time.NewTicker(gossipInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-m.shutdown:
+            return
+        case <-ticker.C:
+            m.sendPeerExchange(conn)
+        }
+    }
+}
+
+// sendPeerExchange sends our signed peer entries to every known peer.
+func (m *Messenger) sendPeerExchange(conn *net.UDPConn) {
+    pex := peerExchange{Type: "pex", SenderID: m.ID}
+    var targets []*net.UDPAddr
+
+    m.peersMutex.RLock()
+    for _, p := range m.peers {
+        if p.ID == m.ID {
+            continue
+        }
+        if p.Port != 0 {
+            targets = append(targets, &net.UDPAddr{IP: net.ParseIP(p.Address), Port: p.Port})
+        }
+        // Peers that did not sign the address we reach them on cannot be
+        // verified by others, so are not shared
+        if p.ID == "" || len(p.EndpointSignature) == 0 || len(pex.Peers) >= gossipMaxEntries {
+            continue
+        }
+        if p.Endpoint != net.JoinHostPort(p.Address, strconv.Itoa(p.Port)) {
+            continue
+        }
+        pex.Peers = append(pex.Peers, gossipEntry{
+            ID:                p.ID,
+            Address:           p.Address,
+            Port:              p.Port,
+            MessagePort:       p.MessagePort,
+            LastSeen:          p.LastSeen,
+            PublicKey:         p.PublicKey,
+            SignedAt:          p.SignedAt,
+            Signature:         p.Signature,
+            Endpoint:          p.Endpoint,
+            EndpointSignature: p.EndpointSignature,
+        })
+    }
+    m.peersMutex.RUnlock()
+
+    if len(pex.Peers) == 0 || len(targets) == 0 {
+        return
+    }
+
+    data, err := json.Marshal(pex)
+    if err != nil {
+        return
+    }
+    for _, addr := range targets {
+        conn.WriteToUDP(data, addr)
+    }
+}
+
+// handlePeerExchange merges the entries of a peer exchange into the peer
+// table, and probes newly learned peers so they learn about us too.
+func (m *Messenger) handlePeerExchange(conn *net.UDPConn, data []byte) {
+    var pex peerExchange
+    if err := json.Unmarshal(data, &pex); err != nil {
+        return
+    }
+
+    learned, problems := m.mergePeerExchange(pex)
+    for _, problem := range problems {
+        log.Printf("Ignoring gossip from %s: %v", pex.SenderID, problem)
+    }
+    for _, addr := range learned {
+        m.sendBeacon(conn, addr, true)
+    }
+}
+
+// mergePeerExchange adds the verified entries of pex to the peer table.
+// An entry must carry the peer's signed endpoint, and its ID must be the
+// one derived from its key, so nobody can gossip another peer's ID with
+// their own key. Peers we hear from directly are not overwritten by gossip
+// until they go quiet. It returns the addresses of peers learned, and why
+// entries were rejected, for the caller to log once peersMutex is released.
+func (m *Messenger) mergePeerExchange(pex peerExchange) ([]*net.UDPAddr, []error) {
+    var learned []*net.UDPAddr
+    var problems []error
+
+    m.peersMutex.Lock()
+    defer m.peersMutex.Unlock()
+
+    for _, e := range pex.Peers {
+        if e.ID == "" || e.ID == m.ID || time.Since(e.SignedAt) > gossipMaxAge {
+            continue
+        }
+
+        if e.Endpoint == "" || e.Endpoint != net.JoinHostPort(e.Address, strconv.Itoa(e.Port)) {
+            problems = append(problems, fmt.Errorf("address of peer %s is not signed", e.ID))
+            continue
+        }
+        if e.ID != peerIDFor(e.PublicKey) {
+            problems = append(problems, fmt.Errorf("ID of peer %s is not derived from its key", e.ID))
+            continue
+        }
+        candidate := Peer{
+            ID:                e.ID,
+            MessagePort:       e.MessagePort,
+            PublicKey:         e.PublicKey,
+            SignedAt:          e.SignedAt,
+            Signature:         e.Signature,
+            Endpoint:          e.Endpoint,
+            EndpointSignature: e.EndpointSignature,
+        }
+        if err := verifyBeacon(&candidate); err != nil {
+            problems = append(problems, err)
+            continue
+        }
+        if err := m.checkIdentity(e.ID, e.PublicKey); err != nil {
+            problems = append(problems, err)
+            continue
+        }
+
+        peer, ok := m.peers[e.ID]
+        if ok && peer.Via == "" && peer.active() {
+            continue
+        }
+        if ok && !e.SignedAt.After(peer.SignedAt) {
+            continue
+        }
+        // Gossip never replaces a key, even one that is not pinned
+        if ok && len(peer.PublicKey) > 0 && !bytes.Equal(peer.PublicKey, e.PublicKey) {
+            problems = append(problems, fmt.Errorf("public key for peer %s changed", e.ID))
+            continue
+        }
+        if !ok {
+            peer = &Peer{ID: e.ID}
+            m.peers[e.ID] = peer
+            learned = append(learned, &net.UDPAddr{IP: net.ParseIP(e.Address), Port: e.Port})
+        }
+
+        lastSeen := e.SignedAt
+        if lastSeen.After(time.Now()) {
+            lastSeen = time.Now()
+        }
+        peer.Address = e.Address
+        peer.Port = e.Port
+        peer.MessagePort = e.MessagePort
+        peer.Interface = m.interfaceFor(net.ParseIP(e.Address))
+        peer.LastSeen = lastSeen
+        peer.PublicKey = e.PublicKey
+        peer.SignedAt = e.SignedAt
+        peer.Signature = e.Signature
+        peer.Endpoint = e.Endpoint
+        peer.EndpointSignature = e.EndpointSignature
+        peer.Via = pex.SenderID
+        peer.Gossiped = true
+        if !peer.Connected && peer.active() {
+            peer.Connected = true
+            m.publish(PeerJoined{newPeerInfo(peer)})
+        }
+    }
+    return learned, problems
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+    "net"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// gossipAbout returns the entry a neighbour would share about n, reached
+// at address and port.
+func gossipAbout(n *Messenger, address string, port int) gossipEntry {
+    beacon := signedBeacon(n, net.JoinHostPort(address, strconv.Itoa(port)))
+    return gossipEntry{
+        ID:                beacon.ID,
+        Address:           address,
+        Port:              port,
+        MessagePort:       beacon.MessagePort,
+        LastSeen:          beacon.SignedAt,
+        PublicKey:         beacon.PublicKey,
+        SignedAt:          beacon.SignedAt,
+        Signature:         beacon.Signature,
+        Endpoint:          beacon.Endpoint,
+        EndpointSignature: beacon.EndpointSignature,
+    }
+}
+
+func TestMergePeerExchange(t *testing.T) {
+    victim, attacker := testNode(t), testNode(t)
+    const sender = "0123456789abcdef"
+
+    // forged is the attacker's entry claiming the victim's ID
+    forged := gossipAbout(attacker, "192.0.2.66", 35001)
+    forgedBeacon := Peer{ID: victim.ID, MessagePort: forged.MessagePort}
+    attacker.signBeacon(&forgedBeacon, "192.0.2.66:35001")
+    forged.ID, forged.Signature, forged.EndpointSignature = victim.ID, forgedBeacon.Signature, forgedBeacon.EndpointSignature
+    forged.SignedAt = forgedBeacon.SignedAt
+
+    tests := []struct {
+        name        string
+        known       *Peer // stored under the entry's ID, nil for none
+        entry       gossipEntry
+        err         string
+        wantAddress string // address of the entry's peer afterwards, "" for none
+        learned     bool
+    }{
+        {
+            name:        "new peer",
+            entry:       gossipAbout(victim, "192.0.2.1", 35001),
+            wantAddress: "192.0.2.1",
+            learned:     true,
+        },
+        {
+            name:  "ID not derived from key",
+            entry: forged,
+            err:   "not derived from its key",
+        },
+        {
+            name: "address not signed",
+            entry: func() gossipEntry {
+                e := gossipAbout(victim, "192.0.2.1", 35001)
+                e.Address = "192.0.2.66"
+                return e
+            }(),
+            err: "address of peer",
+        },
+        {
+            name: "signed endpoint changed",
+            entry: func() gossipEntry {
+                e := gossipAbout(victim, "192.0.2.1", 35001)
+                e.Address, e.Endpoint = "192.0.2.66", "192.0.2.66:35001"
+                return e
+            }(),
+            err: "bad endpoint signature",
+        },
+        {
+            name: "message port changed",
+            entry: func() gossipEntry {
+                e := gossipAbout(victim, "192.0.2.1", 35001)
+                e.MessagePort = 4444
+                return e
+            }(),
+            err: "bad signature",
+        },
+        {
+            name: "too old",
+            entry: func() gossipEntry {
+                e := gossipAbout(victim, "192.0.2.1", 35001)
+                e.SignedAt = e.SignedAt.Add(-2 * gossipMaxAge)
+                return e
+            }(),
+        },
+        {
+            name:        "direct peer still active",
+            known:       &Peer{Address: "192.0.2.2", Port: 35001, PublicKey: victim.publicKey, KeyPinned: true, LastSeen: time.Now()},
+            entry:       gossipAbout(victim, "192.0.2.1", 35001),
+            wantAddress: "192.0.2.2",
+        },
+        {
+            name:        "direct peer gone quiet",
+            known:       &Peer{Address: "192.0.2.2", Port: 35001, PublicKey: victim.publicKey, KeyPinned: true, LastSeen: time.Now().Add(-time.Minute)},
+            entry:       gossipAbout(victim, "192.0.2.1", 35001),
+            wantAddress: "192.0.2.1",
+        },
+        {
+            name:        "older than what we know",
+            known:       &Peer{Address: "192.0.2.2", Port: 35001, PublicKey: victim.publicKey, Via: sender, SignedAt: time.Now().Add(time.Minute)},
+            entry:       gossipAbout(victim, "192.0.2.1", 35001),
+            wantAddress: "192.0.2.2",
+        },
+        {
+            name:        "known key changed",
+            known:       &Peer{Address: "192.0.2.2", Port: 35001, PublicKey: attacker.publicKey, Via: sender},
+            entry:       gossipAbout(victim, "192.0.2.1", 35001),
+            err:         "changed",
+            wantAddress: "192.0.2.2",
+        },
+    }
+
+    for _, test := range tests {
+        m := testNode(t)
+        if test.known != nil {
+            test.known.ID = test.entry.ID
+            m.peers[test.entry.ID] = test.known
+        }
+
+        learned, problems := m.mergePeerExchange(peerExchange{Type: "pex", SenderID: sender, Peers: []gossipEntry{test.entry}})
+        switch {
+        case test.err == "" && len(problems) > 0:
+            t.Errorf("%s: %v", test.name, problems)
+        case test.err != "" && (len(problems) != 1 || !strings.Contains(problems[0].Error(), test.err)):
+            t.Errorf("%s: got problems %v, want %q", test.name, problems, test.err)
+        }
+        if (len(learned) > 0) != test.learned {
+            t.Errorf("%s: learned %v, want %v", test.name, learned, test.learned)
+        }
+
+        peer, ok := m.peers[test.entry.ID]
+        switch {
+        case test.wantAddress == "" && ok:
+            t.Errorf("%s: peer %s was added", test.name, test.entry.ID)
+        case test.wantAddress != "" && !ok:
+            t.Errorf("%s: peer %s missing", test.name, test.entry.ID)
+        case ok && peer.Address != test.wantAddress:
+            t.Errorf("%s: address %s, want %s", test.name, peer.Address, test.wantAddress)
+        }
+    }
+}
+
+func TestMergePeerExchangeNewPeer(t *testing.T) {
+    m, peer := testNode(t), testNode(t)
+    entry := gossipAbout(peer, "192.0.2.1", 35001)
+    m.mergePeerExchange(peerExchange{Type: "pex", SenderID: "0123456789abcdef", Peers: []gossipEntry{entry, gossipAbout(m, "192.0.2.9", 35001)}})
+
+    if _, ok := m.peers[m.ID]; ok {
+        t.Errorf("gossip about ourselves was merged")
+    }
+    got := m.peers[peer.ID]
+    if got == nil {
+        t.Fatalf("peer not learned")
+    }
+    if got.Via != "0123456789abcdef" || !got.Gossiped || got.KeyPinned || !got.Connected {
+        t.Errorf("got via %q, gossiped %v, pinned %v, connected %v", got.Via, got.Gossiped, got.KeyPinned, got.Connected)
+    }
+    if !got.active() {
+        t.Errorf("freshly gossiped peer is not active")
+    }
+}
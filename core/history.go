@@ -0,0 +1,279 @@
+package core
+
+import (
+    "crypto/ed25519"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+)
+
+const maxHistory = 500 // messages kept in memory for replies and edits
+
+// HistoryEntry is a sent or received message as currently displayed, with
+// any edits applied. File contents are not kept.
+type HistoryEntry struct {
+    Message
+    Edited    bool
+    Retracted bool
+    Late      bool      // a reply to it was stored first
+    ExpiresAt time.Time // when an ephemeral message is discarded, zero if never
+}
+
+// addHistory stores a text or file message so later replies, edits and
+// retractions can refer to it. It reports whether the message arrived
+// late, after a message that causally follows it was already shown.
+func (m *Messenger) addHistory(msg Message) bool {
+    if msg.ID == "" {
+        return false
+    }
+    msg.Data = nil // file contents are saved to disk, not kept in memory
+
+    m.historyMutex.Lock()
+    defer m.historyMutex.Unlock()
+
+    if _, ok := m.history[msg.ID]; ok {
+        return false
+    }
+    entry := &HistoryEntry{Message: msg}
+    if msg.TTL > 0 {
+        // Expiry runs from when we stored it, so clock skew between
+        // peers cannot shorten or extend it
+        entry.ExpiresAt = time.Now().Add(msg.TTL)
+    }
+    // Lamport clocks cannot tell late messages from concurrent ones, so a
+    // message only counts as late if a reply to it was already stored
+    for _, stored := range m.history {
+        if stored.ReplyTo == msg.ID {
+            entry.Late = true
+            break
+        }
+    }
+
+    m.history[msg.ID] = entry
+    m.historyOrder = append(m.historyOrder, msg.ID)
+    if len(m.historyOrder) > maxHistory {
+        delete(m.history, m.historyOrder[0])
+        m.historyOrder = m.historyOrder[1:]
+    }
+    return entry.Late
+}
+
+// findHistory looks up a stored message by ID or unique ID prefix.
+// Caller must hold historyMutex.
+func (m *Messenger) findHistory(prefix string) (*HistoryEntry, error) {
+    if entry, ok := m.history[prefix]; ok {
+        return entry, nil
+    }
+
+    var match *HistoryEntry
+    for id, entry := range m.history {
+        if strings.HasPrefix(id, prefix) {
+            if match != nil {
+                return nil, fmt.Errorf("message ID %s is ambiguous", prefix)
+            }
+            match = entry
+        }
+    }
+    if match == nil {
+        return nil, fmt.Errorf("no message with ID %s", prefix)
+    }
+    return match, nil
+}
+
+// ResolveMessageID expands a message ID prefix to the full stored ID.
+func (m *Messenger) ResolveMessageID(prefix string) (string, error) {
+    m.historyMutex.RLock()
+    defer m.historyMutex.RUnlock()
+
+    entry, err := m.findHistory(prefix)
+    if err != nil {
+        return "", err
+    }
+    return entry.ID, nil
+}
+
+// editSignedBytes returns the part of an edit or retraction covered by its
+// signature.
+func editSignedBytes(msg Message) []byte {
+    return []byte(fmt.Sprintf("%s|%s|%s|%s|%s|%d|%d",
+        msg.Type, msg.ID, msg.RefID, msg.SenderID, msg.Content, msg.Timestamp.UnixNano(), msg.Clock))
+}
+
+// newEdit builds a signed edit or retraction of one of our own messages.
+// kind is "edit" or "retract".
+func (m *Messenger) newEdit(kind, prefix, content string) (Message, error) {
+    m.historyMutex.RLock()
+    entry, err := m.findHistory(prefix)
+    var refID, senderID string
+    if err == nil {
+        refID, senderID = entry.ID, entry.SenderID
+    }
+    m.historyMutex.RUnlock()
+
+    if err != nil {
+        return Message{}, err
+    }
+    if senderID != m.ID {
+        return Message{}, fmt.Errorf("message %s was not sent by us", refID)
+    }
+
+    msg := Message{
+        ID:        newMessageID(),
+        Type:      kind,
+        RefID:     refID,
+        Content:   content,
+        Timestamp: time.Now(),
+        SenderID:  m.ID,
+        Clock:     m.nextClock(),
+    }
+    msg.Signature = ed25519.Sign(m.identity, editSignedBytes(msg))
+    return msg, nil
+}
+
+// applyEdit updates a stored message from a verified edit or retraction.
+// It returns the updated entry, or nil if we no longer have the message.
+func (m *Messenger) applyEdit(msg Message) (*HistoryEntry, error) {
+    if msg.SenderID != m.ID {
+        m.peersMutex.RLock()
+        peer, ok := m.peers[msg.SenderID]
+        var publicKey []byte
+        if ok {
+            publicKey = peer.PublicKey
+        }
+        m.peersMutex.RUnlock()
+
+        if len(publicKey) != ed25519.PublicKeySize {
+            return nil, fmt.Errorf("no identity key for %s", msg.SenderID)
+        }
+        if !ed25519.Verify(publicKey, editSignedBytes(msg), msg.Signature) {
+            return nil, fmt.Errorf("bad signature on %s from %s", msg.Type, msg.SenderID)
+        }
+    }
+
+    m.historyMutex.Lock()
+    defer m.historyMutex.Unlock()
+
+    entry, ok := m.history[msg.RefID]
+    if !ok {
+        return nil, nil
+    }
+    if entry.SenderID != msg.SenderID {
+        return nil, fmt.Errorf("%s tried to %s a message from %s",
+            msg.SenderID, msg.Type, entry.SenderID)
+    }
+
+    switch msg.Type {
+    case "edit":
+        entry.Content = msg.Content
+        entry.Edited = true
+    case "retract":
+        entry.Content = ""
+        entry.Retracted = true
+    }
+    updated := *entry
+    return &updated, nil
+}
+
+func (m *Messenger) expireLoop() {
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-m.shutdown:
+            return
+        case <-ticker.C:
+            if ids := m.expireHistory(); len(ids) > 0 {
+                m.publish(MessagesExpired{ids})
+            }
+        }
+    }
+}
+
+// expireHistory discards ephemeral messages whose TTL has passed, from the
+// history, unacknowledged alerts and sent-message receipts. It returns the
+// IDs of the messages that expired.
+func (m *Messenger) expireHistory() []string {
+    now := time.Now()
+    expired := make(map[string]bool)
+
+    m.historyMutex.Lock()
+    kept := m.historyOrder[:0]
+    for _, id := range m.historyOrder {
+        entry := m.history[id]
+        if !entry.ExpiresAt.IsZero() && now.After(entry.ExpiresAt) {
+            delete(m.history, id)
+            expired[id] = true
+            continue
+        }
+        kept = append(kept, id)
+    }
+    m.historyOrder = kept
+    m.historyMutex.Unlock()
+
+    if len(expired) == 0 {
+        return nil
+    }
+
+    m.receiptsMutex.Lock()
+    var pending []Message
+    for _, alert := range m.pendingAcks {
+        if !expired[alert.ID] {
+            pending = append(pending, alert)
+        }
+    }
+    m.pendingAcks = pending
+    for id := range expired {
+        if sent, ok := m.sent[id]; ok {
+            sent.Content = "[expired]"
+        }
+    }
+    m.receiptsMutex.Unlock()
+
+    ids := make([]string, 0, len(expired))
+    for id := range expired {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    return ids
+}
+
+// sortedHistory returns the stored messages in causal order: by Lamport
+// clock, with ties (concurrent messages) broken by time and sender.
+// Messages from peers without clocks sort by time alone.
+// Caller must hold historyMutex.
+func (m *Messenger) sortedHistory() []*HistoryEntry {
+    entries := make([]*HistoryEntry, 0, len(m.history))
+    for _, entry := range m.history {
+        entries = append(entries, entry)
+    }
+    sort.Slice(entries, func(i, j int) bool {
+        a, b := entries[i], entries[j]
+        if a.Clock != 0 && b.Clock != 0 && a.Clock != b.Clock {
+            return a.Clock < b.Clock
+        }
+        if !a.Timestamp.Equal(b.Timestamp) {
+            return a.Timestamp.Before(b.Timestamp)
+        }
+        return a.SenderID < b.SenderID
+    })
+    return entries
+}
+
+// History returns the last n stored messages in causal order, or all of
+// them if n is not positive.
+func (m *Messenger) History(n int) []HistoryEntry {
+    m.historyMutex.RLock()
+    defer m.historyMutex.RUnlock()
+
+    entries := m.sortedHistory()
+    if n > 0 && len(entries) > n {
+        entries = entries[len(entries)-n:]
+    }
+    history := make([]HistoryEntry, len(entries))
+    for i, entry := range entries {
+        history[i] = *entry
+    }
+    return history
+}
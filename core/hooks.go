@@ -0,0 +1,93 @@
+package core
+
+import (
+    "fmt"
+    "log"
+    "strings"
+    "time"
+)
+
+// Hook reacts to events on behalf of the user, for example by answering
+// messages. It may send through the Messenger it is given like any other
+// caller.
+type Hook interface {
+    HandleEvent(m *Messenger, e Event) error
+}
+
+// HookFunc lets an ordinary function be used as a Hook.
+type HookFunc func(m *Messenger, e Event) error
+
+func (f HookFunc) HandleEvent(m *Messenger, e Event) error {
+    return f(m, e)
+}
+
+// AddHook runs h for every event from now on, one event at a time in a
+// goroutine of its own, until the returned function is called or the
+// messenger is closed. Errors h returns are logged under name.
+func (m *Messenger) AddHook(name string, h Hook) func() {
+    events, stop := m.Subscribe()
+    go func() {
+        for e := range events {
+            if err := h.HandleEvent(m, e); err != nil {
+                log.Printf("Hook %s: %v", name, err)
+            }
+        }
+    }()
+    return stop
+}
+
+// command returns the message e received and whether it is the bot command
+// name, such as "!ping", ignoring case and surrounding space.
+func command(e Event, name string) (Message, bool) {
+    text, ok := e.(TextReceived)
+    if !ok || text.Late {
+        return Message{}, false
+    }
+    return text.Message, strings.EqualFold(strings.TrimSpace(text.Message.Content), name)
+}
+
+// Reply sends text to the sender of msg only, as a reply to it.
+func (m *Messenger) Reply(msg Message, text string) error {
+    result, err := m.Send(text, SendOptions{To: msg.SenderID, ReplyTo: msg.ID})
+    if err != nil {
+        return err
+    }
+    if len(result.Failed) > 0 {
+        return result.Failed[0]
+    }
+    return nil
+}
+
+// PingHook answers "!ping" with "pong", so peers can check the node is up.
+func PingHook() Hook {
+    return HookFunc(func(m *Messenger, e Event) error {
+        if msg, ok := command(e, "!ping"); ok {
+            return m.Reply(msg, "pong")
+        }
+        return nil
+    })
+}
+
+// StatusHook answers "!status" with the node's presence, peers and uptime.
+func StatusHook() Hook {
+    return HookFunc(func(m *Messenger, e Event) error {
+        msg, ok := command(e, "!status")
+        if !ok {
+            return nil
+        }
+
+        state, text, idle := m.Presence()
+        if state == "" {
+            state = PresenceAvailable
+        }
+        if text != "" {
+            state += ": " + text
+        }
+        if idle {
+            state += " (idle)"
+        }
+        total, active := m.PeerCounts()
+        uptime := time.Since(m.Stats().StartTime).Round(time.Second)
+        return m.Reply(msg, fmt.Sprintf("%s, %d peers (%d active), up %s", state, total, active, uptime))
+    })
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/sha256"
+    "fmt"
+    "time"
+)
+
+// peerIDFor derives a peer's ID from its identity key, so an ID cannot be
+// claimed with another key.
+func peerIDFor(publicKey []byte) string {
+    sum := sha256.Sum256(publicKey)
+    return fmt.Sprintf("%x", sum[:8])
+}
+
+// beaconSignedBytes returns the part of a beacon covered by its signature.
+// Only fields that identify the peer are signed, so beacons from newer
+// versions with extra fields still verify.
+func beaconSignedBytes(peer *Peer) []byte {
+    return []byte(fmt.Sprintf("beacon|%s|%x|%d|%d",
+        peer.ID, peer.PublicKey, peer.SignedAt.UnixNano(), peer.MessagePort))
+}
+
+// endpointSignedBytes extends beaconSignedBytes with the address the
+// beacon was sent from. It has a signature of its own so that versions
+// that do not know the endpoint still verify the beacon.
+func endpointSignedBytes(peer *Peer) []byte {
+    return []byte(fmt.Sprintf("endpoint|%s|%s", beaconSignedBytes(peer), peer.Endpoint))
+}
+
+// signBeacon fills in the identity fields of a beacon about to be sent
+// from endpoint, which is empty if our address is not known.
+func (m *Messenger) signBeacon(peer *Peer, endpoint string) {
+    peer.PublicKey = m.publicKey
+    peer.SignedAt = time.Now()
+    peer.Signature = ed25519.Sign(m.identity, beaconSignedBytes(peer))
+    if endpoint != "" {
+        peer.Endpoint = endpoint
+        peer.EndpointSignature = ed25519.Sign(m.identity, endpointSignedBytes(peer))
+    }
+}
+
+// verifyBeacon checks that a beacon was signed by the key it carries, and
+// so was its endpoint if it has one.
+func verifyBeacon(peer *Peer) error {
+    if len(peer.PublicKey) != ed25519.PublicKeySize {
+        return fmt.Errorf("missing or invalid public key")
+    }
+    if !ed25519.Verify(peer.PublicKey, beaconSignedBytes(peer), peer.Signature) {
+        return fmt.Errorf("bad signature for peer %s", peer.ID)
+    }
+    if peer.Endpoint != "" || len(peer.EndpointSignature) > 0 {
+        if !ed25519.Verify(peer.PublicKey, endpointSignedBytes(peer), peer.EndpointSignature) {
+            return fmt.Errorf("bad endpoint signature for peer %s", peer.ID)
+        }
+    }
+    return nil
+}
+
+// checkIdentity rejects a public key that differs from the one a peer
+// signed its own beacons with; the first such key seen for an ID is
+// trusted. Keys learned through gossip are not pinned, so the peer's own
+// beacon still replaces them. Once any key is known, unsigned beacons for
+// the ID are rejected. Caller must hold peersMutex.
+func (m *Messenger) checkIdentity(id string, publicKey []byte) error {
+    known, ok := m.peers[id]
+    if !ok || len(known.PublicKey) == 0 {
+        return nil
+    }
+    if len(publicKey) == 0 {
+        return fmt.Errorf("unsigned beacon for peer %s, whose key is known", id)
+    }
+    if known.KeyPinned && !bytes.Equal(known.PublicKey, publicKey) {
+        return fmt.Errorf("public key for peer %s changed", id)
+    }
+    return nil
+}
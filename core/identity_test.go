@@ -0,0 +1,112 @@
+package core
+
+import (
+    "crypto/ed25519"
+    "strings"
+    "testing"
+    "time"
+)
+
+// testNode returns a messenger with an identity key and nothing else set
+// up, enough to sign beacons and merge gossip.
+func testNode(t *testing.T) *Messenger {
+    publicKey, identity, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &Messenger{
+        ID:          peerIDFor(publicKey),
+        identity:    identity,
+        publicKey:   publicKey,
+        peers:       make(map[string]*Peer),
+        subscribers: make(map[chan Event]bool),
+    }
+}
+
+// signedBeacon returns a beacon from n, signed for endpoint.
+func signedBeacon(n *Messenger, endpoint string) Peer {
+    beacon := Peer{ID: n.ID, MessagePort: DefaultMessagePort}
+    n.signBeacon(&beacon, endpoint)
+    return beacon
+}
+
+func TestPeerIDFor(t *testing.T) {
+    a, b := testNode(t), testNode(t)
+    if len(a.ID) != 16 {
+        t.Errorf("ID %q is not 16 hex digits", a.ID)
+    }
+    if a.ID == b.ID {
+        t.Errorf("different keys gave the same ID %s", a.ID)
+    }
+    if peerIDFor(a.publicKey) != a.ID {
+        t.Errorf("ID is not stable")
+    }
+}
+
+func TestVerifyBeacon(t *testing.T) {
+    node, other := testNode(t), testNode(t)
+    tests := []struct {
+        name   string
+        tamper func(p *Peer)
+        err    string
+    }{
+        {"valid", func(p *Peer) {}, ""},
+        {"valid without endpoint", func(p *Peer) { p.Endpoint, p.EndpointSignature = "", nil }, ""},
+        {"other ID", func(p *Peer) { p.ID = other.ID }, "bad signature"},
+        {"other message port", func(p *Peer) { p.MessagePort++ }, "bad signature"},
+        {"other time", func(p *Peer) { p.SignedAt = p.SignedAt.Add(time.Second) }, "bad signature"},
+        {"other key", func(p *Peer) { p.PublicKey = other.publicKey }, "bad signature"},
+        {"missing key", func(p *Peer) { p.PublicKey = nil }, "missing or invalid public key"},
+        {"short key", func(p *Peer) { p.PublicKey = p.PublicKey[:16] }, "missing or invalid public key"},
+        {"missing signature", func(p *Peer) { p.Signature = nil }, "bad signature"},
+        {"other endpoint", func(p *Peer) { p.Endpoint = "192.0.2.66:35001" }, "bad endpoint signature"},
+        {"endpoint without signature", func(p *Peer) { p.EndpointSignature = nil }, "bad endpoint signature"},
+        {"endpoint signature without endpoint", func(p *Peer) { p.Endpoint = "" }, "bad endpoint signature"},
+        {"beacon signature as endpoint signature", func(p *Peer) { p.EndpointSignature = p.Signature }, "bad endpoint signature"},
+    }
+
+    for _, test := range tests {
+        beacon := signedBeacon(node, "192.0.2.1:35001")
+        test.tamper(&beacon)
+        err := verifyBeacon(&beacon)
+        switch {
+        case test.err == "" && err != nil:
+            t.Errorf("%s: %v", test.name, err)
+        case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+            t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+        }
+    }
+}
+
+func TestCheckIdentity(t *testing.T) {
+    node, other := testNode(t), testNode(t)
+    tests := []struct {
+        name  string
+        known *Peer // stored under node's ID, nil for none
+        key   []byte
+        err   string
+    }{
+        {"unknown peer", nil, node.publicKey, ""},
+        {"unknown peer, unsigned", nil, nil, ""},
+        {"no key known, unsigned", &Peer{}, nil, ""},
+        {"same key", &Peer{PublicKey: node.publicKey, KeyPinned: true}, node.publicKey, ""},
+        {"unsigned once key is known", &Peer{PublicKey: node.publicKey}, nil, "unsigned beacon"},
+        {"pinned key changed", &Peer{PublicKey: node.publicKey, KeyPinned: true}, other.publicKey, "changed"},
+        {"gossiped key replaced by beacon", &Peer{PublicKey: other.publicKey}, node.publicKey, ""},
+    }
+
+    for _, test := range tests {
+        m := testNode(t)
+        if test.known != nil {
+            test.known.ID = node.ID
+            m.peers[node.ID] = test.known
+        }
+        err := m.checkIdentity(node.ID, test.key)
+        switch {
+        case test.err == "" && err != nil:
+            t.Errorf("%s: %v", test.name, err)
+        case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+            t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+        }
+    }
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "sort"
+    "strings"
+)
+
+// broadcastTarget is a local IPv4 subnet beacons are broadcast to.
+type broadcastTarget struct {
+    Interface string
+    Network   *net.IPNet
+    Broadcast net.IP
+    Local     net.IP // our address on the subnet
+}
+
+// localBroadcastTargets lists the directed broadcast address of every IPv4
+// subnet on the selected interfaces. selection is "auto" for every
+// interface that is up and supports broadcast, or a comma-separated list
+// of interface names.
+func localBroadcastTargets(selection string) ([]broadcastTarget, error) {
+    ifaces, err := net.Interfaces()
+    if err != nil {
+        return nil, fmt.Errorf("unable to list interfaces: %v", err)
+    }
+
+    wanted := make(map[string]bool)
+    if selection != "auto" {
+        for _, name := range strings.Split(selection, ",") {
+            if name = strings.TrimSpace(name); name != "" {
+                wanted[name] = false
+            }
+        }
+    }
+
+    var targets []broadcastTarget
+    for _, iface := range ifaces {
+        if len(wanted) > 0 {
+            if _, ok := wanted[iface.Name]; !ok {
+                continue
+            }
+            wanted[iface.Name] = true
+        } else if iface.Flags&net.FlagLoopback != 0 {
+            continue
+        }
+        if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+            continue
+        }
+
+        addrs, err := iface.Addrs()
+        if err != nil {
+            continue
+        }
+        for _, addr := range addrs {
+            ipnet, ok := addr.(*net.IPNet)
+            if !ok {
+                continue
+            }
+            ip := ipnet.IP.To4()
+            if ip == nil || len(ipnet.Mask) != net.IPv4len {
+                continue
+            }
+
+            broadcast := make(net.IP, net.IPv4len)
+            for i := range ip {
+                broadcast[i] = ip[i] | ^ipnet.Mask[i]
+            }
+            targets = append(targets, broadcastTarget{
+                Interface: iface.Name,
+                Network:   &net.IPNet{IP: ip.Mask(ipnet.Mask), Mask: ipnet.Mask},
+                Broadcast: broadcast,
+                Local:     ip,
+            })
+        }
+    }
+
+    for name, found := range wanted {
+        if !found {
+            return nil, fmt.Errorf("no such interface: %s", name)
+        }
+    }
+    return targets, nil
+}
+
+// interfaceFor returns the name of the local interface whose subnet
+// contains ip, or "" if the peer is not on a directly attached subnet.
+// Caller must hold peersMutex.
+func (m *Messenger) interfaceFor(ip net.IP) string {
+    for _, t := range m.broadcastTargets {
+        if t.Network.Contains(ip) {
+            return t.Interface
+        }
+    }
+    return ""
+}
+
+// refreshBroadcastTargets re-reads the local interfaces, so addresses that
+// change while running are picked up on the next beacon. An error is
+// logged once until it changes.
+func (m *Messenger) refreshBroadcastTargets() ([]broadcastTarget, error) {
+    targets, err := localBroadcastTargets(m.iface)
+    if err == nil && len(targets) == 0 && m.iface != "auto" {
+        err = fmt.Errorf("no IPv4 broadcast address on %s", m.iface)
+    }
+
+    m.peersMutex.Lock()
+    m.broadcastTargets = targets
+    report := err != nil && err.Error() != m.ifaceError
+    m.ifaceError = ""
+    if err != nil {
+        m.ifaceError = err.Error()
+    }
+    m.peersMutex.Unlock()
+
+    if report {
+        log.Printf("Not broadcasting beacons: %v", err)
+    }
+    return targets, err
+}
+
+// InterfaceStatus is a local interface beacons are broadcast on, or with
+// Network nil, another interface peers were found on. Name is empty for
+// peers not on a directly attached subnet.
+type InterfaceStatus struct {
+    Name      string
+    Network   *net.IPNet
+    Broadcast net.IP
+    Peers     int
+}
+
+// Interfaces reports each broadcast interface and how many peers were
+// found on it, followed by the other interfaces peers were found on.
+func (m *Messenger) Interfaces() []InterfaceStatus {
+    m.peersMutex.RLock()
+    defer m.peersMutex.RUnlock()
+
+    counts := make(map[string]int)
+    for _, p := range m.peers {
+        if p.ID != m.ID {
+            counts[p.Interface]++
+        }
+    }
+
+    var status []InterfaceStatus
+    for _, t := range m.broadcastTargets {
+        status = append(status, InterfaceStatus{t.Interface, t.Network, t.Broadcast, counts[t.Interface]})
+        delete(counts, t.Interface)
+    }
+
+    var others []string
+    for name := range counts {
+        others = append(others, name)
+    }
+    sort.Strings(others)
+    for _, name := range others {
+        status = append(status, InterfaceStatus{Name: name, Peers: counts[name]})
+    }
+    return status
+}
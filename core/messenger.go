@@ -0,0 +1,950 @@
+// Package core is the messenger itself: peer discovery, encryption, the
+// wire format and delivery, without any user interface. A program creates
+// a Messenger with New, starts it, sends with Send and SendFile, and reads
+// what arrives from Events, or from channels of its own from Subscribe:
+//
+//   m, err := core.New(core.DefaultConfig())
+//   if err != nil {
+//       log.Fatal(err)
+//   }
+//   if err := m.Start(); err != nil {
+//       log.Fatal(err)
+//   }
+//   defer m.Close()
+//   for event := range m.Events() {
+//       if text, ok := event.(core.TextReceived); ok {
+//           fmt.Println(text.Message.SenderID, text.Message.Content)
+//       }
+//   }
+package core
+
+import (
+    "container/list"
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+)
+
+const (
+    DefaultDiscoveryPort = 35001
+    DefaultMessagePort   = 35002
+    MaxFileSize   = 63 * 1024 // largest file, leaving room for its header in one frame
+    MaxNickname   = 24
+    maxDatagram   = 64 * 1024 // largest discovery packet
+
+    retryInterval      = 5 * time.Second
+    maxRetries         = 12  // 1 minute of retries
+    alertRetryInterval = time.Second
+    maxAlertRetries    = 120 // 2 minutes of retries
+    peerTimeout        = 10 * time.Second // peers not heard from for this long have left
+
+    PriorityNormal = 0
+    PriorityAlert  = 1 // sent ahead of queued traffic and must be acknowledged
+)
+
+type Message struct {
+    ID        string        `json:"id,omitempty"`
+    Type      string        `json:"type"`                // "text", "file", "receipt", "edit" or "retract"
+    Content   string        `json:"content"`             // text content, file name or receipt kind
+    Data      []byte        `json:"data"`                // file data if type is "file"
+    Timestamp time.Time     `json:"timestamp"`
+    SenderID  string        `json:"sender_id"`
+    Size      int64         `json:"size"`                // size in bytes for statistics
+    RefID     string        `json:"ref_id,omitempty"`    // message a receipt, edit or retraction refers to
+    ReplyTo   string        `json:"reply_to,omitempty"`  // message this text replies to
+    Signature []byte        `json:"signature,omitempty"` // sender's signature on edits and retractions
+    Clock     uint64        `json:"clock,omitempty"`     // sender's Lamport clock, 0 from older peers
+    Priority  int           `json:"priority,omitempty"`  // PriorityNormal or PriorityAlert
+    TTL       time.Duration `json:"ttl,omitempty"`       // receivers discard the message this long after it arrives
+}
+
+type Peer struct {
+    Capabilities
+    ID                string
+    Address           string
+    LastSeen          time.Time
+    Connected         bool
+    Probe             bool      `json:",omitempty"` // ask the receiver to answer with its own beacon
+    MessagePort       int       `json:",omitempty"` // UDP port the peer receives messages on
+    Presence          string    `json:",omitempty"` // available, busy, away, offline-soon or custom
+    PresenceText      string    `json:",omitempty"` // note or custom status text
+    Nickname          string    `json:",omitempty"` // display name chosen by the user, not verified
+    PublicKey         []byte                        // ed25519 identity key
+    SignedAt          time.Time                     // time the beacon was signed
+    Signature         []byte                        // signature over ID, PublicKey, SignedAt and MessagePort
+    Endpoint          string    `json:",omitempty"` // address and discovery port the beacon was sent from
+    EndpointSignature []byte    `json:",omitempty"` // signature over the signed fields and Endpoint
+    KeyPinned         bool      `json:"-"`          // PublicKey came from a beacon the peer sent us
+    Port              int       `json:"-"`          // discovery port the peer's beacons come from
+    Static            bool      `json:"-"`          // added by address, kept even without beacons
+    Gossiped          bool      `json:"-"`          // learned through gossip, so probed while active
+    Via               string    `json:"-"`          // ID of the peer that told us about it, if not heard directly
+    Interface         string    `json:"-"`          // local interface whose subnet the peer is on
+}
+
+// active reports whether the peer was heard from recently enough to count
+// as present. Peers known only through gossip are refreshed once per
+// gossip round, so they are given that much longer.
+func (p *Peer) active() bool {
+    timeout := peerTimeout
+    if p.Via != "" {
+        timeout = gossipPeerTimeout
+    }
+    return time.Since(p.LastSeen) < timeout
+}
+
+type Statistics struct {
+    BytesSent      int64
+    BytesReceived  int64
+    MessagesSent   int64
+    MessagesRecvd  int64
+    FilesSent      int64
+    FilesRecvd     int64
+    RawBytesSent   int64 // encoded size before compression
+    WireBytesSent  int64 // encoded size after compression
+    RawBytesRecvd  int64
+    WireBytesRecvd int64
+    Duplicates     int64 // received messages dropped as already seen
+    StartTime      time.Time
+}
+
+type QueuedMessage struct {
+    Message   Message
+    Attempts  int
+    LastTry   time.Time
+}
+
+// Config is how a Messenger joins the network.
+type Config struct {
+    DiscoveryPort int    // UDP port beacons are sent and received on
+    MessagePort   int    // UDP port messages are received on, 0 picks a free one
+    Interfaces    string // "auto" or comma-separated interface names to broadcast on
+    Compress      bool   // compress messages for peers that support it
+    Nickname      string // advertised display name, may be empty
+    PeersFile     string // file listing static peers (host[:port] per line), may be empty
+}
+
+// DefaultConfig is the configuration used when no flags are given.
+func DefaultConfig() Config {
+    return Config{
+        DiscoveryPort: DefaultDiscoveryPort,
+        MessagePort:   DefaultMessagePort,
+        Interfaces:    "auto",
+        Compress:      true,
+    }
+}
+
+type Messenger struct {
+    ID            string
+    peers         map[string]*Peer
+    peersMutex    sync.RWMutex
+    encryptionKey []byte
+    stats         Statistics
+    statsMutex    sync.RWMutex
+    shutdown      chan struct{}
+    closeOnce     sync.Once
+    messageQueue  *list.List
+    queueMutex   sync.RWMutex
+    discoveryConn *net.UDPConn // guarded by peersMutex
+    messageConn   *net.UDPConn
+    discoveryPort int
+    messagePort   int // guarded by peersMutex, 0 until a port chosen by the OS is bound
+    iface         string // "auto" or comma-separated interface names
+    ifaceError    string // last error selecting interfaces, logged once
+    compress      bool   // compress messages for peers that support it
+    presence      string        // our status, guarded by peersMutex
+    presenceText  string        // guarded by peersMutex
+    autoAway      bool          // presence was set to away by idle detection, guarded by peersMutex
+    beaconNow     chan struct{} // triggers an immediate beacon
+    nickname      string        // advertised display name, may be empty
+    identity      ed25519.PrivateKey
+    publicKey     ed25519.PublicKey
+
+    eventsMutex   sync.Mutex
+    subscribers   map[chan Event]bool // open subscriptions, nil once closed
+    events        <-chan Event        // the subscription returned by Events
+    eventsOnce    sync.Once
+
+    broadcastTargets []broadcastTarget // guarded by peersMutex
+
+    receiptsMutex sync.RWMutex
+    sent          map[string]*SentMessage // receipts for messages we sent, by ID
+    sentOrder     []string                // IDs in sent, oldest first
+    unread        []pendingRead           // received messages awaiting a read receipt
+    pendingAcks   []Message               // received alerts the user has not acknowledged
+
+    historyMutex  sync.RWMutex
+    history       map[string]*HistoryEntry // recent text and file messages, by ID
+    historyOrder  []string                 // IDs in history, in arrival order
+
+    clockMutex    sync.Mutex
+    clock         uint64 // Lamport clock
+
+    seen          *seenCache // sender and ID of recently received messages
+
+    typingMutex    sync.Mutex
+    typing         map[string]time.Time // peers typing, by when we last heard
+    lastTypingSent time.Time
+}
+
+// New creates a Messenger with a fresh ID and keys. It does not touch the
+// network until Start.
+func New(cfg Config) (*Messenger, error) {
+    if _, err := localBroadcastTargets(cfg.Interfaces); err != nil {
+        return nil, err
+    }
+    if len(cfg.Nickname) > MaxNickname || strings.ContainsFunc(cfg.Nickname, unicode.IsSpace) {
+        return nil, fmt.Errorf("nickname must be at most %d characters without spaces", MaxNickname)
+    }
+
+    // Generate encryption key
+    key := make([]byte, 32)
+    rand.Read(key)
+
+    // Generate identity key used to sign beacons, which the ID is derived from
+    publicKey, identity, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+
+    m := &Messenger{
+        ID:            peerIDFor(publicKey),
+        peers:         make(map[string]*Peer),
+        encryptionKey: key,
+        shutdown:      make(chan struct{}),
+        messageQueue:  list.New(),
+        identity:      identity,
+        publicKey:     publicKey,
+        discoveryPort: cfg.DiscoveryPort,
+        messagePort:   cfg.MessagePort,
+        iface:         cfg.Interfaces,
+        compress:      cfg.Compress,
+        nickname:      cfg.Nickname,
+        sent:          make(map[string]*SentMessage),
+        history:       make(map[string]*HistoryEntry),
+        seen:          newSeenCache(seenCacheSize),
+        presence:      PresenceAvailable,
+        beaconNow:     make(chan struct{}, 1),
+        typing:        make(map[string]time.Time),
+        subscribers:   make(map[chan Event]bool),
+    }
+    m.stats.StartTime = time.Now()
+
+    if cfg.PeersFile != "" {
+        if err := m.loadPeersFile(cfg.PeersFile); err != nil {
+            return nil, err
+        }
+    }
+    return m, nil
+}
+
+// Start binds the message and discovery ports and starts finding peers
+// and delivering queued messages in the background.
+func (m *Messenger) Start() error {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: m.messagePort})
+    if err != nil {
+        return fmt.Errorf("message port %d: %v", m.messagePort, err)
+    }
+    // Advertise the bound port, which is chosen by the OS when 0 was requested
+    m.peersMutex.Lock()
+    m.messageConn = conn
+    m.messagePort = conn.LocalAddr().(*net.UDPAddr).Port
+    m.peersMutex.Unlock()
+
+    // Share the port so several instances can run on one host
+    lc := net.ListenConfig{Control: reuseAddr}
+    pc, err := lc.ListenPacket(context.Background(), "udp", fmt.Sprintf(":%d", m.discoveryPort))
+    if err != nil {
+        conn.Close()
+        return fmt.Errorf("discovery port %d: %v", m.discoveryPort, err)
+    }
+    m.peersMutex.Lock()
+    m.discoveryConn = pc.(*net.UDPConn)
+    m.peersMutex.Unlock()
+
+    go m.receiveMessages(conn)
+    go m.discover(pc.(*net.UDPConn))
+
+    // Start queue processor
+    go m.processMessageQueue()
+
+    // Notice peers that go quiet
+    go m.watchPeers()
+
+    // Start discarding ephemeral messages once they expire
+    go m.expireLoop()
+    return nil
+}
+
+// Close stops the messenger and releases its ports.
+func (m *Messenger) Close() {
+    m.closeOnce.Do(func() {
+        close(m.shutdown)
+
+        m.peersMutex.Lock()
+        if m.discoveryConn != nil {
+            m.discoveryConn.Close()
+        }
+        if m.messageConn != nil {
+            m.messageConn.Close()
+        }
+        // Clean up peers
+        for id, peer := range m.peers {
+            peer.Connected = false
+            delete(m.peers, id)
+        }
+        m.peersMutex.Unlock()
+
+        m.closeSubscriptions()
+    })
+}
+
+// closed reports whether Close was called.
+func (m *Messenger) closed() bool {
+    select {
+    case <-m.shutdown:
+        return true
+    default:
+        return false
+    }
+}
+
+// MessagePort is the port messages are received on, once Start has bound
+// it.
+func (m *Messenger) MessagePort() int {
+    m.peersMutex.RLock()
+    defer m.peersMutex.RUnlock()
+    return m.messagePort
+}
+
+// Nickname is the display name advertised to peers.
+func (m *Messenger) Nickname() string {
+    return m.nickname
+}
+
+func (m *Messenger) discover(conn *net.UDPConn) {
+    // Broadcast presence and probe static peers periodically, and
+    // straight away when our status changes. The first broadcast is a
+    // probe, so peers answer at once instead of on their next beacon.
+    go func() {
+        probe := true
+        for {
+            m.broadcast(conn, probe)
+            m.probeStaticPeers(conn)
+            probe = false
+            select {
+            case <-time.After(5 * time.Second):
+            case <-m.beaconNow:
+            case <-m.shutdown:
+                return
+            }
+        }
+    }()
+
+    // Share known peers with neighbours
+    go m.gossipLoop(conn)
+
+    // Listen for other peers
+    buffer := make([]byte, maxDatagram)
+    for {
+        n, remoteAddr, err := conn.ReadFromUDP(buffer)
+        if err != nil {
+            if m.closed() {
+                return
+            }
+            continue
+        }
+
+        var packet struct {
+            Type string `json:"type"`
+        }
+        if err := json.Unmarshal(buffer[:n], &packet); err != nil {
+            continue
+        }
+        if packet.Type == "pex" {
+            m.handlePeerExchange(conn, buffer[:n])
+            continue
+        }
+
+        var peer Peer
+        if err := json.Unmarshal(buffer[:n], &peer); err != nil {
+            continue
+        }
+
+        if peer.ID == "" {
+            continue
+        }
+        if err := m.updatePeer(peer, remoteAddr); err != nil {
+            log.Printf("Ignoring beacon from %s: %v", remoteAddr, err)
+            continue
+        }
+
+        // Answer probes directly so static peers learn our ID
+        if peer.Probe {
+            m.sendBeacon(conn, remoteAddr, false)
+        }
+    }
+}
+
+// broadcast sends a beacon to the directed broadcast address of each
+// selected interface. With automatic selection it falls back to the
+// limited broadcast address when no interface qualifies; interfaces named
+// explicitly are never bypassed that way. probe asks every receiver to
+// answer.
+func (m *Messenger) broadcast(conn *net.UDPConn, probe bool) {
+    targets, err := m.refreshBroadcastTargets()
+    if err != nil && m.iface != "auto" {
+        return
+    }
+    if len(targets) == 0 {
+        addr := &net.UDPAddr{
+            IP:   net.IPv4(255, 255, 255, 255),
+            Port: m.discoveryPort,
+        }
+        m.sendBeacon(conn, addr, probe)
+        return
+    }
+
+    for _, t := range targets {
+        m.sendBeacon(conn, &net.UDPAddr{IP: t.Broadcast, Port: m.discoveryPort}, probe)
+    }
+}
+
+func (m *Messenger) sendBeacon(conn *net.UDPConn, addr *net.UDPAddr, probe bool) error {
+    peer := Peer{
+        ID:        m.ID,
+        LastSeen:  time.Now(),
+        Connected: true,
+        Probe:     probe,
+    }
+    peer.Capabilities = localCapabilities()
+    m.peersMutex.RLock()
+    peer.MessagePort = m.messagePort
+    peer.Presence = m.presence
+    peer.PresenceText = m.presenceText
+    m.peersMutex.RUnlock()
+    peer.Nickname = m.nickname
+
+    endpoint := ""
+    if ip := m.localIPFor(addr); ip != nil {
+        endpoint = net.JoinHostPort(ip.String(), strconv.Itoa(m.discoveryPort))
+    }
+    m.signBeacon(&peer, endpoint)
+
+    data, err := json.Marshal(peer)
+    if err != nil {
+        return err
+    }
+
+    _, err = conn.WriteToUDP(data, addr)
+    return err
+}
+
+// localIPFor returns our address on the way to addr, so receivers can
+// pass it on in gossip, or nil if it is not known.
+func (m *Messenger) localIPFor(addr *net.UDPAddr) net.IP {
+    m.peersMutex.RLock()
+    for _, t := range m.broadcastTargets {
+        if t.Broadcast.Equal(addr.IP) {
+            m.peersMutex.RUnlock()
+            return t.Local
+        }
+    }
+    m.peersMutex.RUnlock()
+
+    // Connecting a UDP socket picks the route without sending anything
+    conn, err := net.DialUDP("udp4", nil, addr)
+    if err != nil {
+        return nil
+    }
+    defer conn.Close()
+    return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+func (m *Messenger) encrypt(data []byte) ([]byte, error) {
+    block, err := aes.NewCipher(m.encryptionKey)
+    if err != nil {
+        return nil, err
+    }
+
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+
+    nonce := make([]byte, gcm.NonceSize())
+    if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+        return nil, err
+    }
+
+    return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func (m *Messenger) decrypt(data []byte) ([]byte, error) {
+    block, err := aes.NewCipher(m.encryptionKey)
+    if err != nil {
+        return nil, err
+    }
+
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+
+    nonceSize := gcm.NonceSize()
+    if len(data) < nonceSize {
+        return nil, fmt.Errorf("ciphertext too short")
+    }
+
+    nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+    return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func verifyMemoryForFileSize(fileSize int64) error {
+    availMem, err := checkAvailableMemory()
+    if err != nil {
+        return fmt.Errorf("unable to check memory: %v", err)
+    }
+
+    // Require 1.5x the file size to account for encryption overhead and processing
+    requiredMem := uint64(float64(fileSize) * 1.5)
+    if requiredMem > availMem {
+        return fmt.Errorf("insufficient memory: need %d bytes, have %d bytes available",
+            requiredMem, availMem)
+    }
+    return nil
+}
+
+func (m *Messenger) handleLargeFile(filePath string) error {
+    fileInfo, err := os.Stat(filePath)
+    if err != nil {
+        return fmt.Errorf("unable to stat file: %v", err)
+    }
+
+    if fileInfo.Size() > MaxFileSize {
+        return fmt.Errorf("file too large: %d bytes (max: %d)", fileInfo.Size(), MaxFileSize)
+    }
+
+    if err := verifyMemoryForFileSize(fileInfo.Size()); err != nil {
+        return err
+    }
+
+    // If we get here, we have sufficient memory to process the file
+    return nil
+}
+
+func (m *Messenger) updateStats(msg Message, sent bool) {
+    m.statsMutex.Lock()
+    defer m.statsMutex.Unlock()
+
+    if sent {
+        m.stats.BytesSent += msg.Size
+        if msg.Type == "file" {
+            m.stats.FilesSent++
+        } else {
+            m.stats.MessagesSent++
+        }
+    } else {
+        m.stats.BytesReceived += msg.Size
+        if msg.Type == "file" {
+            m.stats.FilesRecvd++
+        } else {
+            m.stats.MessagesRecvd++
+        }
+    }
+}
+
+// updateWireStats records the encoded size of a message before and after
+// compression.
+func (m *Messenger) updateWireStats(raw, wire int, sent bool) {
+    m.statsMutex.Lock()
+    defer m.statsMutex.Unlock()
+
+    if sent {
+        m.stats.RawBytesSent += int64(raw)
+        m.stats.WireBytesSent += int64(wire)
+    } else {
+        m.stats.RawBytesRecvd += int64(raw)
+        m.stats.WireBytesRecvd += int64(wire)
+    }
+}
+
+// Stats returns a snapshot of the traffic counters.
+func (m *Messenger) Stats() Statistics {
+    m.statsMutex.RLock()
+    defer m.statsMutex.RUnlock()
+    return m.stats
+}
+
+// PeerCounts returns how many peers we know and how many are active.
+func (m *Messenger) PeerCounts() (int, int) {
+    m.peersMutex.RLock()
+    defer m.peersMutex.RUnlock()
+
+    var activeCount int
+    for _, p := range m.peers {
+        if p.active() {
+            activeCount++
+        }
+    }
+    return len(m.peers), activeCount
+}
+
+// String formats the statistics for the status report.
+func (s Statistics) String() string {
+    uptime := time.Since(s.StartTime).Round(time.Second)
+    return fmt.Sprintf(`
+Statistics:
+  Uptime: %s
+  Messages: Sent=%d, Received=%d
+  Files: Sent=%d, Received=%d
+  Data: Sent=%s, Received=%s
+  Compression: Sent %s raw as %s (%s), Received %s raw as %s (%s)
+  Duplicates dropped: %d`,
+        uptime,
+        s.MessagesSent, s.MessagesRecvd,
+        s.FilesSent, s.FilesRecvd,
+        formatBytes(s.BytesSent), formatBytes(s.BytesReceived),
+        formatBytes(s.RawBytesSent), formatBytes(s.WireBytesSent),
+        formatRatio(s.WireBytesSent, s.RawBytesSent),
+        formatBytes(s.RawBytesRecvd), formatBytes(s.WireBytesRecvd),
+        formatRatio(s.WireBytesRecvd, s.RawBytesRecvd),
+        s.Duplicates)
+}
+
+// formatRatio shows wire as a percentage of raw.
+func formatRatio(wire, raw int64) string {
+    if raw == 0 {
+        return "n/a"
+    }
+    return fmt.Sprintf("%.0f%%", float64(wire)*100/float64(raw))
+}
+
+func formatBytes(bytes int64) string {
+    const unit = 1024
+    if bytes < unit {
+        return fmt.Sprintf("%d B", bytes)
+    }
+    div, exp := int64(unit), 0
+    for n := bytes / unit; n >= unit; n /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// receiveMessages handles datagrams arriving on the message port until
+// Close.
+func (m *Messenger) receiveMessages(conn *net.UDPConn) {
+    buffer := make([]byte, maxDatagram)
+    for {
+        n, _, err := conn.ReadFromUDP(buffer)
+        if err != nil {
+            if !m.closed() {
+                log.Printf("Message listener error: %v", err)
+            }
+            return
+        }
+
+        // Process message
+        if err := m.handleMessage(buffer[:n]); err != nil {
+            log.Printf("Error handling message: %v", err)
+        }
+    }
+}
+
+func (m *Messenger) handleMessage(data []byte) error {
+    // Decrypt and handle message
+    decrypted, err := m.decrypt(data)
+    if err != nil {
+        return fmt.Errorf("failed to decrypt: %v", err)
+    }
+
+    msg, rawSize, err := decodeMessage(decrypted)
+    if err != nil {
+        return fmt.Errorf("failed to decode: %v", err)
+    }
+    m.updateWireStats(rawSize, len(decrypted), false)
+
+    // Drop copies of messages already handled, e.g. from retries. The
+    // delivery receipt is repeated in case the first one was lost.
+    if msg.ID != "" && m.seen.check(msg.SenderID+"/"+msg.ID) {
+        m.statsMutex.Lock()
+        m.stats.Duplicates++
+        m.statsMutex.Unlock()
+
+        if msg.Type == "text" || msg.Type == "file" {
+            m.sendReceipt(msg.SenderID, msg.ID, receiptDelivered)
+        }
+        return nil
+    }
+
+    // Receipts are control traffic, not counted as messages
+    switch msg.Type {
+    case "receipt":
+        m.handleReceipt(msg)
+        return nil
+
+    case "typing":
+        m.setTyping(msg.SenderID, true)
+        return nil
+
+    case "edit", "retract":
+        m.observeClock(msg.Clock)
+        entry, err := m.applyEdit(msg)
+        if err != nil || entry == nil {
+            return err
+        }
+        if entry.Retracted {
+            m.publish(MessageRetracted{entry.ID, entry.SenderID})
+        } else {
+            m.publish(MessageEdited{entry.ID, entry.SenderID, entry.Content})
+        }
+        return nil
+    }
+
+    // Update statistics
+    m.updateStats(msg, false)
+    m.observeClock(msg.Clock)
+    m.setTyping(msg.SenderID, false)
+
+    // Handle based on message type
+    switch msg.Type {
+    case "text":
+        late := m.addHistory(msg)
+        if msg.Priority >= PriorityAlert {
+            m.addPendingAck(msg)
+        }
+        m.publish(TextReceived{msg, late})
+
+    case "file":
+        // Create received files directory if it doesn't exist
+        if err := os.MkdirAll("received_files", 0755); err != nil {
+            return fmt.Errorf("failed to create received_files directory: %v", err)
+        }
+
+        // Save file with unique name
+        filename := filepath.Base(msg.Content)
+        savePath := filepath.Join("received_files",
+            fmt.Sprintf("%s_%s", msg.SenderID, filename))
+
+        if err := os.WriteFile(savePath, msg.Data, 0644); err != nil {
+            return fmt.Errorf("failed to save file: %v", err)
+        }
+
+        late := m.addHistory(msg)
+        msg.Data = nil
+        m.publish(FileReceived{msg, savePath, late})
+    }
+
+    // Acknowledge delivery now; the read receipt follows once the user
+    // has seen the message
+    if msg.ID != "" {
+        m.sendReceipt(msg.SenderID, msg.ID, receiptDelivered)
+        m.markUnread(msg)
+    }
+
+    return nil
+}
+
+func (m *Messenger) processMessageQueue() {
+    ticker := time.NewTicker(alertRetryInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-m.shutdown:
+            return
+        case <-ticker.C:
+            m.retryQueuedMessages()
+        }
+    }
+}
+
+func (m *Messenger) retryQueuedMessages() {
+    m.queueMutex.Lock()
+    defer m.queueMutex.Unlock()
+
+    for e := m.messageQueue.Front(); e != nil; {
+        qm := e.Value.(*QueuedMessage)
+        next := e.Next() // Store next before potential removal
+
+        // Ephemeral messages are not delivered after they expire
+        if qm.Message.TTL > 0 && time.Since(qm.Message.Timestamp) > qm.Message.TTL {
+            m.messageQueue.Remove(e)
+            m.publish(DeliveryFailed{withoutData(qm.Message), qm.Attempts, ErrExpired})
+            e = next
+            continue
+        }
+
+        // Alerts are retried more often and for longer
+        interval, maxAttempts := retryInterval, maxRetries
+        if qm.Message.Priority >= PriorityAlert {
+            interval, maxAttempts = alertRetryInterval, maxAlertRetries
+        }
+
+        // Skip if not enough time has passed since last attempt
+        if time.Since(qm.LastTry) < interval {
+            e = next
+            continue
+        }
+
+        // Alerts stay queued until every recipient confirmed delivery,
+        // including alerts sent while no peer was active
+        if qm.Message.Priority >= PriorityAlert {
+            qm.Attempts++
+            qm.LastTry = time.Now()
+            if m.retryAlert(qm.Message) {
+                m.messageQueue.Remove(e)
+            } else if qm.Attempts > maxAttempts {
+                m.messageQueue.Remove(e)
+                err := ErrNotDelivered
+                if !m.hasRecipients(qm.Message.ID) {
+                    err = ErrNoPeers
+                }
+                m.publish(DeliveryFailed{withoutData(qm.Message), qm.Attempts, err})
+            }
+            e = next
+            continue
+        }
+
+        // Try to send the message
+        sent := false
+        m.peersMutex.RLock()
+        for _, peer := range m.peers {
+            if peer.ID != m.ID && peer.active() {
+                added := m.trackRecipient(qm.Message, peer.ID)
+                if err := m.sendToPeer(peer, qm.Message); err == nil {
+                    sent = true
+                } else if added {
+                    m.untrackRecipient(qm.Message.ID, peer.ID)
+                }
+            }
+        }
+        m.peersMutex.RUnlock()
+
+        if sent {
+            // Message sent successfully, remove from queue
+            m.messageQueue.Remove(e)
+            m.publish(QueuedMessageSent{withoutData(qm.Message), qm.Attempts})
+        } else {
+            // Update attempt count and last try time
+            qm.Attempts++
+            qm.LastTry = time.Now()
+            
+            // Remove if too many attempts
+            if qm.Attempts > maxAttempts {
+                m.messageQueue.Remove(e)
+                m.publish(DeliveryFailed{withoutData(qm.Message), qm.Attempts, ErrNoPeers})
+            }
+        }
+
+        e = next
+    }
+}
+
+// withoutData is msg as reported in events, without the file contents.
+func withoutData(msg Message) Message {
+    msg.Data = nil
+    return msg
+}
+
+func (m *Messenger) queueMessage(msg Message) {
+    m.queueMutex.Lock()
+    defer m.queueMutex.Unlock()
+
+    qm := &QueuedMessage{
+        Message:  msg,
+        Attempts: 0,
+        LastTry:  time.Now(),
+    }
+
+    // Alerts go ahead of normal traffic
+    if msg.Priority >= PriorityAlert {
+        m.messageQueue.PushFront(qm)
+        return
+    }
+    m.messageQueue.PushBack(qm)
+}
+
+// retryAlert resends an alert to every active peer that has not confirmed
+// delivery, and reports whether it was sent to at least one peer and every
+// peer it was sent to has.
+func (m *Messenger) retryAlert(msg Message) bool {
+    m.peersMutex.RLock()
+    defer m.peersMutex.RUnlock()
+
+    pending := 0
+    for _, peer := range m.peers {
+        if peer.ID == "" || peer.ID == m.ID || !peer.active() {
+            continue
+        }
+        if m.isDelivered(msg.ID, peer.ID) {
+            continue
+        }
+        pending++
+        added := m.trackRecipient(msg, peer.ID)
+        if err := m.sendToPeer(peer, msg); err != nil && added {
+            m.untrackRecipient(msg.ID, peer.ID)
+        }
+    }
+    return pending == 0 && m.allDelivered(msg.ID)
+}
+
+func (m *Messenger) sendToPeer(peer *Peer, msg Message) error {
+    // Encode in the newest format the peer understands, then encrypt
+    compress := m.compress && peer.hasCompression(compressionDeflate)
+    data, rawSize, err := encodeMessage(msg, negotiateProtocol(peer), compress)
+    if err != nil {
+        return fmt.Errorf("failed to encode message: %v", err)
+    }
+
+    // Skip peers that cannot accept this message
+    if err := peer.checkSend(msg, len(data)); err != nil {
+        return err
+    }
+
+    encrypted, err := m.encrypt(data)
+    if err != nil {
+        return fmt.Errorf("failed to encrypt message: %v", err)
+    }
+
+    // Create UDP connection to peer, on the port it advertised
+    port := peer.MessagePort
+    if port == 0 {
+        port = DefaultMessagePort
+    }
+    addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", peer.Address, port))
+    if err != nil {
+        return fmt.Errorf("failed to resolve peer address: %v", err)
+    }
+
+    conn, err := net.DialUDP("udp", nil, addr)
+    if err != nil {
+        return fmt.Errorf("failed to connect to peer: %v", err)
+    }
+    defer conn.Close()
+
+    // Send the encrypted message
+    _, err = conn.Write(encrypted)
+    if err != nil {
+        return fmt.Errorf("failed to send message: %v", err)
+    }
+
+    m.updateWireStats(rawSize, len(data), true)
+    return nil
+} 
\ No newline at end of file
@@ -0,0 +1,318 @@
+package core
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// loadPeersFile adds every address listed in path as a static peer.
+// Blank lines and lines starting with '#' are ignored.
+func (m *Messenger) loadPeersFile(path string) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("unable to open peers file: %v", err)
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if _, err := m.addStaticPeer(line); err != nil {
+            return err
+        }
+    }
+    return scanner.Err()
+}
+
+// addStaticPeer registers a peer by address so it is probed directly instead
+// of relying on broadcast discovery. The port defaults to our discovery port.
+func (m *Messenger) addStaticPeer(hostport string) (*Peer, error) {
+    if _, _, err := net.SplitHostPort(hostport); err != nil {
+        hostport = net.JoinHostPort(hostport, strconv.Itoa(m.discoveryPort))
+    }
+
+    addr, err := net.ResolveUDPAddr("udp4", hostport)
+    if err != nil {
+        return nil, fmt.Errorf("failed to resolve peer address: %v", err)
+    }
+
+    m.peersMutex.Lock()
+    defer m.peersMutex.Unlock()
+
+    address := addr.IP.String()
+    for _, p := range m.peers {
+        if p.Address == address && p.Port == addr.Port {
+            p.Static = true
+            return p, nil
+        }
+    }
+
+    // Until the peer answers a probe we only know its address, so the
+    // entry is keyed by address and has no ID.
+    peer := &Peer{
+        Address: address,
+        Port:    addr.Port,
+        Static:  true,
+    }
+    m.peers[addr.String()] = peer
+    return peer, nil
+}
+
+// updatePeer records a beacon received from remoteAddr. An address-only
+// static entry for the same host is replaced by the entry for its ID.
+// Signed beacons must verify, and a peer's key may not change.
+func (m *Messenger) updatePeer(beacon Peer, remoteAddr *net.UDPAddr) error {
+    if len(beacon.Signature) > 0 {
+        if err := verifyBeacon(&beacon); err != nil {
+            return err
+        }
+    }
+
+    m.peersMutex.Lock()
+    defer m.peersMutex.Unlock()
+
+    if err := m.checkIdentity(beacon.ID, beacon.PublicKey); err != nil {
+        return err
+    }
+
+    address := remoteAddr.IP.String()
+    static := false
+    for key, p := range m.peers {
+        if p.ID == "" && p.Address == address && p.Port == remoteAddr.Port {
+            delete(m.peers, key)
+            static = true
+        }
+    }
+
+    peer, ok := m.peers[beacon.ID]
+    if !ok {
+        peer = &Peer{ID: beacon.ID}
+        m.peers[beacon.ID] = peer
+    }
+    if !peer.Connected && beacon.ID != m.ID {
+        defer func() { m.publish(PeerJoined{newPeerInfo(peer)}) }()
+    }
+    peer.Address = address
+    peer.Port = remoteAddr.Port
+    peer.Interface = m.interfaceFor(remoteAddr.IP)
+    peer.LastSeen = time.Now()
+    peer.Connected = true
+    peer.MessagePort = beacon.MessagePort
+    peer.Presence = beacon.Presence
+    peer.PresenceText = beacon.PresenceText
+    peer.Nickname = beacon.Nickname
+    peer.Static = peer.Static || static
+
+    // Warn once when a peer appears or upgrades to a version we cannot talk to
+    versionChanged := !ok ||
+        peer.ProtocolVersion != beacon.ProtocolVersion ||
+        peer.MinProtocolVersion != beacon.MinProtocolVersion
+    peer.Capabilities = beacon.Capabilities
+    if versionChanged && beacon.ID != m.ID {
+        if err := beacon.compatible(); err != nil {
+            defer m.publish(PeerIncompatible{newPeerInfo(peer), err})
+        }
+    }
+    peer.Via = ""
+    if len(beacon.Signature) > 0 {
+        peer.PublicKey = beacon.PublicKey
+        peer.KeyPinned = true
+        peer.SignedAt = beacon.SignedAt
+        peer.Signature = beacon.Signature
+        peer.Endpoint = beacon.Endpoint
+        peer.EndpointSignature = beacon.EndpointSignature
+    }
+    return nil
+}
+
+// watchPeers announces peers that stopped sending beacons until the
+// messenger is closed.
+func (m *Messenger) watchPeers() {
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-m.shutdown:
+            return
+        case <-ticker.C:
+            m.expirePeers()
+        }
+    }
+}
+
+// expirePeers marks peers that are no longer active as gone. They stay
+// known, so they are announced again by the next beacon or gossip about
+// them.
+func (m *Messenger) expirePeers() {
+    m.peersMutex.Lock()
+    defer m.peersMutex.Unlock()
+
+    for _, peer := range m.peers {
+        if peer.ID == "" || peer.ID == m.ID || !peer.Connected {
+            continue
+        }
+        if !peer.active() {
+            peer.Connected = false
+            m.publish(PeerLeft{newPeerInfo(peer)})
+        }
+    }
+}
+
+// probeStaticPeers sends a unicast probe to every static peer, and to
+// active peers learned through gossip. Peers answer probes with their own
+// beacon, so they are found and kept even when broadcast is blocked.
+func (m *Messenger) probeStaticPeers(conn *net.UDPConn) {
+    m.peersMutex.RLock()
+    var targets []*net.UDPAddr
+    for _, p := range m.peers {
+        if p.Static || (p.Gossiped && p.active()) {
+            targets = append(targets, &net.UDPAddr{IP: net.ParseIP(p.Address), Port: p.Port})
+        }
+    }
+    m.peersMutex.RUnlock()
+
+    for _, addr := range targets {
+        m.sendBeacon(conn, addr, true)
+    }
+}
+
+// peerIDs lists the IDs of the peers we have heard from.
+func (m *Messenger) peerIDs() []string {
+    m.peersMutex.RLock()
+    defer m.peersMutex.RUnlock()
+
+    var ids []string
+    for _, peer := range m.peers {
+        if peer.ID != "" && peer.ID != m.ID {
+            ids = append(ids, peer.ID)
+        }
+    }
+    sort.Strings(ids)
+    return ids
+}
+
+// resolvePeer finds a peer by ID, nickname or unique ID prefix and returns
+// its ID.
+func (m *Messenger) resolvePeer(name string) (string, error) {
+    m.peersMutex.RLock()
+    defer m.peersMutex.RUnlock()
+
+    var matches []string
+    for _, peer := range m.peers {
+        if peer.ID == "" || peer.ID == m.ID {
+            continue
+        }
+        if peer.ID == name {
+            return peer.ID, nil
+        }
+        if peer.Nickname == name || strings.HasPrefix(peer.ID, name) {
+            matches = append(matches, peer.ID)
+        }
+    }
+    switch len(matches) {
+    case 0:
+        return "", fmt.Errorf("no peer %s found", name)
+    case 1:
+        return matches[0], nil
+    }
+    return "", fmt.Errorf("peer %s is ambiguous: %s", name, strings.Join(matches, ", "))
+}
+
+// Connect adds a static peer by host[:port] and probes it immediately. It
+// returns the address being probed.
+func (m *Messenger) Connect(hostport string) (string, error) {
+    peer, err := m.addStaticPeer(hostport)
+    if err != nil {
+        return "", err
+    }
+
+    m.peersMutex.RLock()
+    conn := m.discoveryConn
+    addr := &net.UDPAddr{IP: net.ParseIP(peer.Address), Port: peer.Port}
+    m.peersMutex.RUnlock()
+
+    if conn == nil {
+        return addr.String(), fmt.Errorf("discovery not running, %s will be probed once it starts", addr)
+    }
+    if err := m.sendBeacon(conn, addr, true); err != nil {
+        return addr.String(), fmt.Errorf("failed to probe peer: %v", err)
+    }
+    return addr.String(), nil
+}
+
+// PeerInfo is a discovered peer as reported to users of the package.
+type PeerInfo struct {
+    ID           string    `json:"id"`
+    Nickname     string    `json:"nickname,omitempty"`
+    Address      string    `json:"address"`
+    MessagePort  int       `json:"messagePort,omitempty"`
+    Interface    string    `json:"interface,omitempty"`
+    Via          string    `json:"via,omitempty"`
+    Static       bool      `json:"static,omitempty"`
+    Presence     string    `json:"presence,omitempty"`
+    PresenceText string    `json:"presenceText,omitempty"`
+    Version      string    `json:"version,omitempty"`
+    Compatible   bool      `json:"compatible"`
+    Active       bool      `json:"active"` // heard from recently, directly or through gossip
+    LastSeen     time.Time `json:"lastSeen"`
+}
+
+func newPeerInfo(peer *Peer) PeerInfo {
+    return PeerInfo{
+        ID:           peer.ID,
+        Nickname:     peer.Nickname,
+        Address:      peer.Address,
+        MessagePort:  peer.MessagePort,
+        Interface:    peer.Interface,
+        Via:          peer.Via,
+        Static:       peer.Static,
+        Presence:     peer.Presence,
+        PresenceText: peer.PresenceText,
+        Version:      peer.SoftwareVersion,
+        Compatible:   peer.compatible() == nil,
+        Active:       peer.active(),
+        LastSeen:     peer.LastSeen,
+    }
+}
+
+// Peers describes the discovered peers, ordered by ID.
+func (m *Messenger) Peers() []PeerInfo {
+    m.peersMutex.RLock()
+    defer m.peersMutex.RUnlock()
+
+    infos := []PeerInfo{}
+    for _, peer := range m.peers {
+        if peer.ID == "" || peer.ID == m.ID {
+            continue
+        }
+        infos = append(infos, newPeerInfo(peer))
+    }
+    sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+    return infos
+}
+
+// PendingPeers lists the addresses of static peers that have not answered
+// a probe yet.
+func (m *Messenger) PendingPeers() []string {
+    m.peersMutex.RLock()
+    defer m.peersMutex.RUnlock()
+
+    var addrs []string
+    for _, peer := range m.peers {
+        if peer.ID == "" {
+            addrs = append(addrs, net.JoinHostPort(peer.Address, strconv.Itoa(peer.Port)))
+        }
+    }
+    sort.Strings(addrs)
+    return addrs
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+    "strings"
+    "time"
+)
+
+// Presence states carried in beacons. A custom status has free text only.
+const (
+    PresenceAvailable   = "available"
+    PresenceBusy        = "busy"
+    PresenceAway        = "away"
+    PresenceOfflineSoon = "offline-soon"
+    PresenceCustom      = "custom"
+)
+
+var presenceStates = []string{PresenceAvailable, PresenceBusy, PresenceAway, PresenceOfflineSoon}
+
+// ParsePresence splits "busy in a meeting" into state and note. Text that
+// does not start with a known state becomes a custom status.
+func ParsePresence(input string) (string, string) {
+    input = strings.TrimSpace(input)
+    first, rest, _ := strings.Cut(input, " ")
+    for _, state := range presenceStates {
+        if strings.EqualFold(first, state) {
+            return state, strings.TrimSpace(rest)
+        }
+    }
+    return PresenceCustom, input
+}
+
+// SetPresence changes our status and announces it right away instead of
+// waiting for the next beacon.
+func (m *Messenger) SetPresence(state, text string) {
+    m.setPresence(state, text, false)
+}
+
+// setPresence is SetPresence, where auto marks a change made by idle
+// detection, which is undone on the next user input.
+func (m *Messenger) setPresence(state, text string, auto bool) {
+    m.peersMutex.Lock()
+    m.presence = state
+    m.presenceText = text
+    m.autoAway = auto
+    m.peersMutex.Unlock()
+
+    select {
+    case m.beaconNow <- struct{}{}:
+    default:
+    }
+}
+
+// Presence returns our status and note, and whether it was set to away by
+// idle detection.
+func (m *Messenger) Presence() (string, string, bool) {
+    m.peersMutex.RLock()
+    defer m.peersMutex.RUnlock()
+    return m.presence, m.presenceText, m.autoAway
+}
+
+// CheckIdle switches an available user to away after idle time without
+// input, and back once they type again.
+func (m *Messenger) CheckIdle(lastInput time.Time, idle time.Duration) {
+    m.peersMutex.RLock()
+    state, auto := m.presence, m.autoAway
+    m.peersMutex.RUnlock()
+
+    idleNow := idle > 0 && time.Since(lastInput) >= idle
+    switch {
+    case idleNow && state == PresenceAvailable:
+        m.setPresence(PresenceAway, "", true)
+    case !idleNow && auto:
+        m.setPresence(PresenceAvailable, "", false)
+    }
+}
@@ -0,0 +1,308 @@
+package core
+
+import (
+    "crypto/rand"
+    "fmt"
+    "strings"
+    "time"
+)
+
+const (
+    receiptDelivered = "delivered"
+    receiptRead      = "read"
+    receiptAck       = "ack" // explicit acknowledgement of an alert
+
+    maxTrackedMessages = 100 // sent messages whose receipts are kept
+)
+
+// ReceiptStatus is what one recipient has acknowledged for a message.
+type ReceiptStatus struct {
+    Delivered time.Time
+    Read      time.Time
+    Acked     time.Time
+}
+
+// SentMessage tracks receipts for a message we sent.
+type SentMessage struct {
+    ID         string
+    Type       string
+    Content    string
+    Priority   int
+    SentAt     time.Time
+    Recipients map[string]ReceiptStatus
+}
+
+// pendingRead is a received message not yet seen by the user.
+type pendingRead struct {
+    SenderID  string
+    MessageID string
+}
+
+func newMessageID() string {
+    id := make([]byte, 8)
+    rand.Read(id)
+    return fmt.Sprintf("%x", id)
+}
+
+// trackRecipient records that msg is being handed to peerID. It is called
+// before sending, so a receipt that comes back quickly is not ignored, and
+// reports whether peerID was not a recipient already.
+func (m *Messenger) trackRecipient(msg Message, peerID string) bool {
+    if msg.ID == "" {
+        return false
+    }
+
+    m.receiptsMutex.Lock()
+    defer m.receiptsMutex.Unlock()
+
+    sent, ok := m.sent[msg.ID]
+    if !ok {
+        sent = &SentMessage{
+            ID:         msg.ID,
+            Type:       msg.Type,
+            Content:    msg.Content,
+            Priority:   msg.Priority,
+            SentAt:     time.Now(),
+            Recipients: make(map[string]ReceiptStatus),
+        }
+        m.sent[msg.ID] = sent
+        m.sentOrder = append(m.sentOrder, msg.ID)
+        if len(m.sentOrder) > maxTrackedMessages {
+            delete(m.sent, m.sentOrder[0])
+            m.sentOrder = m.sentOrder[1:]
+        }
+    }
+    if _, ok := sent.Recipients[peerID]; ok {
+        return false
+    }
+    sent.Recipients[peerID] = ReceiptStatus{}
+    return true
+}
+
+// untrackRecipient undoes trackRecipient when sending to peerID failed.
+func (m *Messenger) untrackRecipient(id, peerID string) {
+    m.receiptsMutex.Lock()
+    defer m.receiptsMutex.Unlock()
+
+    if sent, ok := m.sent[id]; ok {
+        delete(sent.Recipients, peerID)
+    }
+}
+
+// isDelivered reports whether peerID confirmed delivery of message id.
+func (m *Messenger) isDelivered(id, peerID string) bool {
+    m.receiptsMutex.RLock()
+    defer m.receiptsMutex.RUnlock()
+
+    if sent, ok := m.sent[id]; ok {
+        if status, ok := sent.Recipients[peerID]; ok {
+            return !status.Delivered.IsZero()
+        }
+    }
+    return false
+}
+
+// hasRecipients reports whether message id was handed to any peer.
+func (m *Messenger) hasRecipients(id string) bool {
+    m.receiptsMutex.RLock()
+    defer m.receiptsMutex.RUnlock()
+
+    sent, ok := m.sent[id]
+    return ok && len(sent.Recipients) > 0
+}
+
+// allDelivered reports whether message id was handed to at least one peer
+// and every one of them confirmed delivery.
+func (m *Messenger) allDelivered(id string) bool {
+    m.receiptsMutex.RLock()
+    defer m.receiptsMutex.RUnlock()
+
+    sent, ok := m.sent[id]
+    if !ok || len(sent.Recipients) == 0 {
+        return false
+    }
+    for _, status := range sent.Recipients {
+        if status.Delivered.IsZero() {
+            return false
+        }
+    }
+    return true
+}
+
+// handleReceipt records a receipt from the recipient of one of our messages.
+// Receipts from peers the message was not sent to are ignored, and receipts
+// are stamped with when they arrived, since the peer's clock may be off.
+func (m *Messenger) handleReceipt(msg Message) {
+    m.receiptsMutex.Lock()
+    defer m.receiptsMutex.Unlock()
+
+    sent, ok := m.sent[msg.RefID]
+    if !ok {
+        return
+    }
+    status, ok := sent.Recipients[msg.SenderID]
+    if !ok {
+        return
+    }
+    defer func() { sent.Recipients[msg.SenderID] = status }()
+
+    now := time.Now()
+
+    switch msg.Content {
+    case receiptAck:
+        if status.Acked.IsZero() {
+            status.Acked = now
+            m.publish(AlertAcknowledged{sent.ID, msg.SenderID})
+        }
+        fallthrough
+    case receiptRead:
+        if status.Read.IsZero() {
+            status.Read = now
+        }
+        // A read message was necessarily delivered
+        fallthrough
+    case receiptDelivered:
+        if status.Delivered.IsZero() {
+            status.Delivered = now
+        }
+    }
+}
+
+// sendReceipt acknowledges message refID to the peer that sent it.
+func (m *Messenger) sendReceipt(peerID, refID, kind string) error {
+    m.peersMutex.RLock()
+    peer, ok := m.peers[peerID]
+    m.peersMutex.RUnlock()
+    if !ok {
+        return fmt.Errorf("unknown peer %s", peerID)
+    }
+
+    receipt := Message{
+        Type:      "receipt",
+        ID:        newMessageID(),
+        RefID:     refID,
+        Content:   kind,
+        Timestamp: time.Now(),
+        SenderID:  m.ID,
+    }
+    return m.sendToPeer(peer, receipt)
+}
+
+// markUnread remembers a received message so a read receipt can be sent
+// once the user has had a chance to see it.
+func (m *Messenger) markUnread(msg Message) {
+    if msg.ID == "" {
+        return
+    }
+
+    m.receiptsMutex.Lock()
+    m.unread = append(m.unread, pendingRead{SenderID: msg.SenderID, MessageID: msg.ID})
+    m.receiptsMutex.Unlock()
+}
+
+// MarkAllRead sends read receipts for every message received so far, once
+// the user has seen them.
+func (m *Messenger) MarkAllRead() {
+    m.receiptsMutex.Lock()
+    unread := m.unread
+    m.unread = nil
+    m.receiptsMutex.Unlock()
+
+    for _, u := range unread {
+        m.sendReceipt(u.SenderID, u.MessageID, receiptRead)
+    }
+}
+
+// addPendingAck remembers an alert until the user acknowledges it.
+func (m *Messenger) addPendingAck(msg Message) {
+    m.receiptsMutex.Lock()
+    m.pendingAcks = append(m.pendingAcks, msg)
+    m.receiptsMutex.Unlock()
+}
+
+// AcknowledgeAlerts sends an ack for each pending alert whose ID starts
+// with prefix, or for all of them if prefix is "all". It returns the
+// acknowledged alerts.
+func (m *Messenger) AcknowledgeAlerts(prefix string) []Message {
+    m.receiptsMutex.Lock()
+    var acked, remaining []Message
+    for _, alert := range m.pendingAcks {
+        if prefix == "all" || strings.HasPrefix(alert.ID, prefix) {
+            acked = append(acked, alert)
+        } else {
+            remaining = append(remaining, alert)
+        }
+    }
+    m.pendingAcks = remaining
+    m.receiptsMutex.Unlock()
+
+    for _, alert := range acked {
+        m.sendReceipt(alert.SenderID, alert.ID, receiptAck)
+    }
+    return acked
+}
+
+// PendingAlerts lists received alerts that have not been acknowledged yet.
+func (m *Messenger) PendingAlerts() []Message {
+    m.receiptsMutex.RLock()
+    defer m.receiptsMutex.RUnlock()
+
+    return append([]Message(nil), m.pendingAcks...)
+}
+
+// findSent looks up a sent message by ID or unique ID prefix.
+// Caller must hold receiptsMutex.
+func (m *Messenger) findSent(prefix string) (*SentMessage, error) {
+    if sent, ok := m.sent[prefix]; ok {
+        return sent, nil
+    }
+
+    var match *SentMessage
+    for id, sent := range m.sent {
+        if strings.HasPrefix(id, prefix) {
+            if match != nil {
+                return nil, fmt.Errorf("message ID %s is ambiguous", prefix)
+            }
+            match = sent
+        }
+    }
+    if match == nil {
+        return nil, fmt.Errorf("no sent message with ID %s", prefix)
+    }
+    return match, nil
+}
+
+// copy returns a snapshot of sent that is safe to use without the lock.
+func (sent *SentMessage) copy() SentMessage {
+    c := *sent
+    c.Recipients = make(map[string]ReceiptStatus, len(sent.Recipients))
+    for peerID, status := range sent.Recipients {
+        c.Recipients[peerID] = status
+    }
+    return c
+}
+
+// Receipts lists the receipts of recently sent messages, oldest first.
+func (m *Messenger) Receipts() []SentMessage {
+    m.receiptsMutex.RLock()
+    defer m.receiptsMutex.RUnlock()
+
+    receipts := make([]SentMessage, 0, len(m.sentOrder))
+    for _, id := range m.sentOrder {
+        receipts = append(receipts, m.sent[id].copy())
+    }
+    return receipts
+}
+
+// Receipt returns the receipts of the sent message with the given ID or
+// unique ID prefix.
+func (m *Messenger) Receipt(id string) (SentMessage, error) {
+    m.receiptsMutex.RLock()
+    defer m.receiptsMutex.RUnlock()
+
+    sent, err := m.findSent(id)
+    if err != nil {
+        return SentMessage{}, err
+    }
+    return sent.copy(), nil
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package core
+
+import (
+    "syscall"
+)
+
+// reuseAddr lets several instances on one host bind the discovery port.
+// On Linux SO_REUSEADDR is enough for every socket to receive broadcasts.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+    var sockErr error
+    err := c.Control(func(fd uintptr) {
+        sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+    })
+    if err != nil {
+        return err
+    }
+    return sockErr
+}
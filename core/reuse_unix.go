@@ -0,0 +1,23 @@
+//go:build !windows && !linux
+
+package core
+
+import (
+    "syscall"
+)
+
+// reuseAddr lets several instances on one host bind the discovery port.
+// Broadcast beacons are delivered to every socket sharing the port.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+    var sockErr error
+    err := c.Control(func(fd uintptr) {
+        sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+        if sockErr == nil {
+            sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1)
+        }
+    })
+    if err != nil {
+        return err
+    }
+    return sockErr
+}
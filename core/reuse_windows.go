@@ -0,0 +1,19 @@
+//go:build windows
+
+package core
+
+import (
+    "syscall"
+)
+
+// reuseAddr lets several instances on one host bind the discovery port.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+    var sockErr error
+    err := c.Control(func(fd uintptr) {
+        sockErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+    })
+    if err != nil {
+        return err
+    }
+    return sockErr
+}
@@ -0,0 +1,288 @@
+package core
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "time"
+)
+
+// ErrNotDelivered is the PeerError of a peer that did not confirm delivery
+// in time, and the DeliveryFailed error of an alert not every peer
+// confirmed.
+var ErrNotDelivered = errors.New("delivery not confirmed")
+
+// ErrNoPeers and ErrExpired are why a queued message was given up on, as
+// reported by DeliveryFailed.
+var (
+    ErrNoPeers = errors.New("no peer reachable")
+    ErrExpired = errors.New("expired before it was delivered")
+)
+
+// SendOptions control how Send and SendFile deliver a message.
+type SendOptions struct {
+    To      string        // peer ID, unique ID prefix or nickname, empty for every peer
+    ReplyTo string        // ID of the message a text replies to
+    TTL     time.Duration // receivers discard a text this long after it arrives
+    Alert   bool          // send a text as a priority alert every peer must acknowledge
+    Wait    time.Duration // wait this long for peers to appear and confirm delivery, 0 to send once
+}
+
+// SendResult reports what happened to a sent message.
+type SendResult struct {
+    ID         string
+    Type       string      // "text" or "file", or "edit" or "retract" with ID the changed message
+    Recipients int         // peers the message was handed to, or with Wait, waited for
+    Delivered  int         // peers that confirmed delivery, counted only with Wait
+    Queued     bool        // no peer took it, so it is retried in the background
+    Failed     []PeerError // peers it could not be sent to, or with Wait, that did not confirm
+}
+
+// PeerError is why a message did not reach one peer.
+type PeerError struct {
+    PeerID string
+    Err    error
+}
+
+func (e PeerError) Error() string {
+    return fmt.Sprintf("sending to %s: %v", e.PeerID, e.Err)
+}
+
+func (e PeerError) Unwrap() error {
+    return e.Err
+}
+
+// Send sends a text message to every peer, or to opts.To. Without
+// opts.Wait it returns once the message is handed to the peers found so
+// far, queueing it if there are none; alerts are queued regardless, and
+// resent until every peer confirms.
+func (m *Messenger) Send(text string, opts SendOptions) (SendResult, error) {
+    if text == "" {
+        return SendResult{}, fmt.Errorf("empty message")
+    }
+    msg := Message{
+        ID:        newMessageID(),
+        Type:      "text",
+        Content:   text,
+        Timestamp: time.Now(),
+        SenderID:  m.ID,
+        Size:      int64(len(text)),
+        ReplyTo:   opts.ReplyTo,
+        TTL:       opts.TTL,
+    }
+    if opts.Alert {
+        msg.Priority = PriorityAlert
+    }
+    return m.send(msg, opts)
+}
+
+// SendFile sends the file at path like Send. Receivers see its base name.
+func (m *Messenger) SendFile(path string, opts SendOptions) (SendResult, error) {
+    // Check if file exists and memory is sufficient
+    if err := m.handleLargeFile(path); err != nil {
+        return SendResult{}, err
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return SendResult{}, fmt.Errorf("reading file: %v", err)
+    }
+
+    msg := Message{
+        ID:        newMessageID(),
+        Type:      "file",
+        Content:   path,
+        Data:      data,
+        Timestamp: time.Now(),
+        SenderID:  m.ID,
+        Size:      int64(len(data)),
+    }
+    return m.send(msg, opts)
+}
+
+func (m *Messenger) send(msg Message, opts SendOptions) (SendResult, error) {
+    result := SendResult{ID: msg.ID, Type: msg.Type}
+
+    if opts.Wait > 0 {
+        deadline := time.Now().Add(opts.Wait)
+        peerIDs, err := m.waitForPeers(opts.To, deadline)
+        if err != nil {
+            return SendResult{}, err
+        }
+        msg.Clock = m.nextClock()
+        m.addHistory(msg)
+
+        result.Recipients = len(peerIDs)
+        result.Delivered, result.Failed = m.sendUntilDelivered(msg, peerIDs, deadline)
+        m.updateStats(msg, true)
+        return result, nil
+    }
+
+    var to string
+    if opts.To != "" {
+        var err error
+        if to, err = m.resolvePeer(opts.To); err != nil {
+            return SendResult{}, err
+        }
+    }
+    msg.Clock = m.nextClock()
+    m.addHistory(msg)
+
+    m.peersMutex.RLock()
+    for _, peer := range m.peers {
+        if peer.ID == "" || peer.ID == m.ID || (to != "" && peer.ID != to) {
+            continue
+        }
+        added := m.trackRecipient(msg, peer.ID)
+        if err := m.sendToPeer(peer, msg); err != nil {
+            if added {
+                m.untrackRecipient(msg.ID, peer.ID)
+            }
+            result.Failed = append(result.Failed, PeerError{peer.ID, err})
+            continue
+        }
+        result.Recipients++
+    }
+    m.peersMutex.RUnlock()
+
+    // Alerts stay queued until every active peer has confirmed delivery
+    if result.Recipients == 0 || msg.Priority >= PriorityAlert {
+        m.queueMessage(msg)
+        result.Queued = result.Recipients == 0
+    }
+    if result.Recipients > 0 {
+        m.updateStats(msg, true)
+    }
+    return result, nil
+}
+
+// Edit replaces the text of a message we sent, given its ID or a unique
+// prefix, for every peer.
+func (m *Messenger) Edit(id, text string) (SendResult, error) {
+    return m.sendEdit("edit", id, text)
+}
+
+// Retract withdraws a message we sent from every peer.
+func (m *Messenger) Retract(id string) (SendResult, error) {
+    return m.sendEdit("retract", id, "")
+}
+
+// sendEdit sends a signed edit or retraction of one of our own messages.
+// kind is "edit" or "retract".
+func (m *Messenger) sendEdit(kind, id, content string) (SendResult, error) {
+    msg, err := m.newEdit(kind, id, content)
+    if err != nil {
+        return SendResult{}, err
+    }
+    if _, err := m.applyEdit(msg); err != nil {
+        return SendResult{}, err
+    }
+
+    result := SendResult{ID: msg.RefID, Type: kind}
+    m.peersMutex.RLock()
+    for _, peer := range m.peers {
+        if peer.ID == "" || peer.ID == m.ID {
+            continue
+        }
+        if err := m.sendToPeer(peer, msg); err != nil {
+            result.Failed = append(result.Failed, PeerError{peer.ID, err})
+            continue
+        }
+        result.Recipients++
+    }
+    m.peersMutex.RUnlock()
+
+    if result.Recipients == 0 {
+        m.queueMessage(msg)
+        result.Queued = true
+    }
+    return result, nil
+}
+
+// waitForPeers returns the ID of the peer named to once it is discovered,
+// or with to empty, every peer that answered shortly after the first.
+func (m *Messenger) waitForPeers(to string, deadline time.Time) ([]string, error) {
+    var settle time.Time
+    for {
+        if to != "" {
+            id, err := m.resolvePeer(to)
+            if err == nil {
+                return []string{id}, nil
+            }
+            if time.Now().After(deadline) {
+                return nil, err
+            }
+        } else if ids := m.peerIDs(); len(ids) > 0 {
+            // Peers answer our first beacon at about the same time
+            if settle.IsZero() {
+                settle = time.Now().Add(500 * time.Millisecond)
+            }
+            if time.Now().After(settle) || time.Now().After(deadline) {
+                return ids, nil
+            }
+        } else if time.Now().After(deadline) {
+            return nil, fmt.Errorf("no peers found")
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+}
+
+// sendUntilDelivered sends msg to each peer, repeating every second to
+// those that have not confirmed delivery until the deadline. It returns
+// how many confirmed, and why the others did not.
+func (m *Messenger) sendUntilDelivered(msg Message, peerIDs []string, deadline time.Time) (int, []PeerError) {
+    failed := make(map[string]bool)
+    var problems []PeerError
+    settled := func() bool {
+        for _, id := range peerIDs {
+            if !failed[id] && !m.isDelivered(msg.ID, id) {
+                return false
+            }
+        }
+        return true
+    }
+
+    for {
+        pending := 0
+        m.peersMutex.RLock()
+        for _, id := range peerIDs {
+            if failed[id] || m.isDelivered(msg.ID, id) {
+                continue
+            }
+            pending++
+            peer, ok := m.peers[id]
+            if !ok {
+                continue
+            }
+            added := m.trackRecipient(msg, id)
+            if err := m.sendToPeer(peer, msg); err != nil {
+                if added {
+                    m.untrackRecipient(msg.ID, id)
+                }
+                // Capabilities and size do not change between attempts
+                problems = append(problems, PeerError{id, err})
+                failed[id] = true
+                continue
+            }
+        }
+        m.peersMutex.RUnlock()
+
+        if pending == 0 || time.Now().After(deadline) {
+            break
+        }
+        // Give receipts a second to arrive before sending again
+        for wait := time.Now().Add(time.Second); time.Now().Before(wait) && !settled(); {
+            time.Sleep(100 * time.Millisecond)
+        }
+    }
+
+    delivered := 0
+    for _, id := range peerIDs {
+        if m.isDelivered(msg.ID, id) {
+            delivered++
+        } else if !failed[id] {
+            problems = append(problems, PeerError{id, ErrNotDelivered})
+        }
+    }
+    return delivered, problems
+}
+
@@ -0,0 +1,74 @@
+package core
+
+import (
+    "sort"
+    "time"
+)
+
+const (
+    typingInterval = 3 * time.Second // at most one notification per interval
+    typingTimeout  = 5 * time.Second // indicator disappears without a refresh
+)
+
+// NotifyTyping tells active peers that we are typing. Calls closer together
+// than typingInterval are dropped, so it can be called on every keystroke.
+func (m *Messenger) NotifyTyping() {
+    m.typingMutex.Lock()
+    if time.Since(m.lastTypingSent) < typingInterval {
+        m.typingMutex.Unlock()
+        return
+    }
+    m.lastTypingSent = time.Now()
+    m.typingMutex.Unlock()
+
+    msg := Message{
+        Type:      "typing",
+        Timestamp: time.Now(),
+        SenderID:  m.ID,
+    }
+
+    m.peersMutex.RLock()
+    defer m.peersMutex.RUnlock()
+    for _, peer := range m.peers {
+        if peer.ID == m.ID || !peer.active() {
+            continue
+        }
+        if peer.hasFeature(featureTyping) {
+            m.sendToPeer(peer, msg)
+        }
+    }
+}
+
+// setTyping records a typing notification from peerID, or clears it when
+// typing is false because the peer's message arrived.
+func (m *Messenger) setTyping(peerID string, typing bool) {
+    m.typingMutex.Lock()
+    _, wasTyping := m.typing[peerID]
+    if typing {
+        m.typing[peerID] = time.Now()
+    } else {
+        delete(m.typing, peerID)
+    }
+    m.typingMutex.Unlock()
+
+    if typing != wasTyping {
+        m.publish(TypingChanged{peerID, typing})
+    }
+}
+
+// TypingPeers lists peers whose typing notification has not timed out.
+func (m *Messenger) TypingPeers() []string {
+    m.typingMutex.Lock()
+    defer m.typingMutex.Unlock()
+
+    var peers []string
+    for id, at := range m.typing {
+        if time.Since(at) >= typingTimeout {
+            delete(m.typing, id)
+            continue
+        }
+        peers = append(peers, id)
+    }
+    sort.Strings(peers)
+    return peers
+}
@@ -0,0 +1,261 @@
+package core
+
+import (
+    "bytes"
+    "compress/flate"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "io"
+    "time"
+)
+
+// Binary frame layout (protocol 2 and later), before encryption:
+//
+//    magic    2 bytes  "NR"
+//    version  1 byte   protocol version the frame is encoded with
+//    flags    1 byte   compression algorithm of the body, 0 for none
+//    hdrLen   4 bytes  big-endian length of the uncompressed header
+//    header   hdrLen bytes of fields: tag (1 byte), uvarint length, value
+//    payload  remaining bytes, the raw file data
+//
+// When flags names an algorithm, header and payload together are stored
+// compressed. Unknown header tags are skipped so newer senders can add
+// fields. Protocol 1 peers send and expect the JSON encoding of Message instead.
+var frameMagic = []byte("NR")
+
+const (
+    frameHeaderSize = 8
+    binaryProtocol  = 2 // first protocol version using binary frames
+
+    // A frame travels encrypted in one datagram, so it may be no larger
+    // than a UDP payload less the nonce and tag added by encrypt
+    maxUDPPayload = 65507
+    gcmOverhead   = 28
+    maxFrameSize  = maxUDPPayload - gcmOverhead
+)
+
+// Compression algorithms, by name as advertised in Capabilities and by the
+// flag value recorded in the frame.
+const (
+    compressNone    = 0
+    compressDeflate = 1
+
+    compressionDeflate = "deflate"
+)
+
+// Header field tags
+const (
+    tagType      = 1
+    tagContent   = 2
+    tagTimestamp = 3
+    tagSenderID  = 4
+    tagSize      = 5
+    tagID        = 6
+    tagRefID     = 7
+    tagReplyTo   = 8
+    tagSignature = 9
+    tagClock     = 10
+    tagPriority  = 11
+    tagTTL       = 12
+)
+
+// negotiateProtocol picks the highest protocol both we and peer speak.
+func negotiateProtocol(peer *Peer) int {
+    if v := peer.protocol(); v < protocolVersion {
+        return v
+    }
+    return protocolVersion
+}
+
+// encodeMessage serializes msg for a peer speaking the given protocol. If
+// compress is set the body is deflated, unless that would not make it
+// smaller. It returns the frame and its size before compression.
+func encodeMessage(msg Message, version int, compress bool) ([]byte, int, error) {
+    if version < binaryProtocol {
+        data, err := json.Marshal(msg)
+        if err == nil && len(data) > maxFrameSize {
+            return nil, 0, fmt.Errorf("message too large: %d bytes (max: %d)", len(data), maxFrameSize)
+        }
+        return data, len(data), err
+    }
+
+    var header []byte
+    header = appendField(header, tagType, []byte(msg.Type))
+    header = appendField(header, tagContent, []byte(msg.Content))
+    header = appendField(header, tagTimestamp, binary.AppendVarint(nil, msg.Timestamp.UnixNano()))
+    header = appendField(header, tagSenderID, []byte(msg.SenderID))
+    header = appendField(header, tagSize, binary.AppendVarint(nil, msg.Size))
+    if msg.ID != "" {
+        header = appendField(header, tagID, []byte(msg.ID))
+    }
+    if msg.RefID != "" {
+        header = appendField(header, tagRefID, []byte(msg.RefID))
+    }
+    if msg.ReplyTo != "" {
+        header = appendField(header, tagReplyTo, []byte(msg.ReplyTo))
+    }
+    if len(msg.Signature) > 0 {
+        header = appendField(header, tagSignature, msg.Signature)
+    }
+    if msg.Clock != 0 {
+        header = appendField(header, tagClock, binary.AppendUvarint(nil, msg.Clock))
+    }
+    if msg.Priority != PriorityNormal {
+        header = appendField(header, tagPriority, binary.AppendVarint(nil, int64(msg.Priority)))
+    }
+    if msg.TTL > 0 {
+        header = appendField(header, tagTTL, binary.AppendVarint(nil, int64(msg.TTL)))
+    }
+
+    // Peers refuse to inflate more than fits in a frame uncompressed
+    rawSize := frameHeaderSize + len(header) + len(msg.Data)
+    if rawSize > maxFrameSize {
+        return nil, 0, fmt.Errorf("message too large: %d bytes (max: %d)", rawSize, maxFrameSize)
+    }
+    flags := byte(compressNone)
+    var body []byte
+    if compress {
+        var buf bytes.Buffer
+        w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+        w.Write(header)
+        w.Write(msg.Data)
+        if err := w.Close(); err != nil {
+            return nil, 0, err
+        }
+        if buf.Len() < len(header)+len(msg.Data) {
+            flags = compressDeflate
+            body = buf.Bytes()
+        }
+    }
+
+    frame := make([]byte, 0, rawSize)
+    frame = append(frame, frameMagic...)
+    frame = append(frame, byte(version), flags)
+    frame = binary.BigEndian.AppendUint32(frame, uint32(len(header)))
+    if flags == compressNone {
+        frame = append(frame, header...)
+        frame = append(frame, msg.Data...)
+    } else {
+        frame = append(frame, body...)
+    }
+    return frame, rawSize, nil
+}
+
+// decodeMessage parses either a binary frame or, for protocol 1 peers,
+// the JSON encoding of a Message. It also returns the size of the frame
+// after decompression.
+func decodeMessage(data []byte) (Message, int, error) {
+    var msg Message
+    if !bytes.HasPrefix(data, frameMagic) {
+        err := json.Unmarshal(data, &msg)
+        return msg, len(data), err
+    }
+
+    if len(data) < frameHeaderSize {
+        return msg, 0, fmt.Errorf("frame too short")
+    }
+    version := int(data[2])
+    if version < binaryProtocol || version > protocolVersion {
+        return msg, 0, fmt.Errorf("unsupported frame version %d", version)
+    }
+
+    body := data[frameHeaderSize:]
+    switch data[3] {
+    case compressNone:
+    case compressDeflate:
+        r := flate.NewReader(bytes.NewReader(body))
+        inflated, err := io.ReadAll(io.LimitReader(r, maxFrameSize-frameHeaderSize+1))
+        if err != nil {
+            return msg, 0, fmt.Errorf("failed to decompress: %v", err)
+        }
+        if frameHeaderSize+len(inflated) > maxFrameSize {
+            return msg, 0, fmt.Errorf("decompressed frame exceeds %d bytes", maxFrameSize)
+        }
+        body = inflated
+    default:
+        return msg, 0, fmt.Errorf("unsupported compression %d", data[3])
+    }
+
+    hdrLen := binary.BigEndian.Uint32(data[4:8])
+    if uint64(hdrLen) > uint64(len(body)) {
+        return msg, 0, fmt.Errorf("frame header truncated")
+    }
+
+    header := body[:hdrLen]
+    for len(header) > 0 {
+        tag := header[0]
+        length, n := binary.Uvarint(header[1:])
+        if n <= 0 || length > uint64(len(header)-1-n) {
+            return msg, 0, fmt.Errorf("malformed header field %d", tag)
+        }
+        value := header[1+n : 1+n+int(length)]
+        header = header[1+n+int(length):]
+
+        switch tag {
+        case tagType:
+            msg.Type = string(value)
+        case tagContent:
+            msg.Content = string(value)
+        case tagTimestamp:
+            nanos, err := readVarint(value)
+            if err != nil {
+                return msg, 0, err
+            }
+            msg.Timestamp = time.Unix(0, nanos)
+        case tagSenderID:
+            msg.SenderID = string(value)
+        case tagSize:
+            size, err := readVarint(value)
+            if err != nil {
+                return msg, 0, err
+            }
+            msg.Size = size
+        case tagID:
+            msg.ID = string(value)
+        case tagRefID:
+            msg.RefID = string(value)
+        case tagReplyTo:
+            msg.ReplyTo = string(value)
+        case tagSignature:
+            msg.Signature = append([]byte(nil), value...)
+        case tagClock:
+            clock, n := binary.Uvarint(value)
+            if n <= 0 {
+                return msg, 0, fmt.Errorf("malformed clock")
+            }
+            msg.Clock = clock
+        case tagPriority:
+            priority, err := readVarint(value)
+            if err != nil {
+                return msg, 0, err
+            }
+            msg.Priority = int(priority)
+        case tagTTL:
+            ttl, err := readVarint(value)
+            if err != nil {
+                return msg, 0, err
+            }
+            msg.TTL = time.Duration(ttl)
+        }
+    }
+
+    if payload := body[hdrLen:]; len(payload) > 0 {
+        msg.Data = append([]byte(nil), payload...)
+    }
+    return msg, frameHeaderSize + len(body), nil
+}
+
+func appendField(header []byte, tag byte, value []byte) []byte {
+    header = append(header, tag)
+    header = binary.AppendUvarint(header, uint64(len(value)))
+    return append(header, value...)
+}
+
+func readVarint(value []byte) (int64, error) {
+    v, n := binary.Varint(value)
+    if n <= 0 {
+        return 0, fmt.Errorf("malformed varint")
+    }
+    return v, nil
+}
@@ -0,0 +1,264 @@
+package core
+
+import (
+    "bytes"
+    "compress/flate"
+    "encoding/binary"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// sameMessage reports whether a and b are equal, comparing timestamps as
+// instants since encodings do not keep the location.
+func sameMessage(a, b Message) bool {
+    if !a.Timestamp.Equal(b.Timestamp) {
+        return false
+    }
+    a.Timestamp, b.Timestamp = time.Time{}, time.Time{}
+    return reflect.DeepEqual(a, b)
+}
+
+// frame builds a binary frame around header and payload, uncompressed.
+func frame(version int, header, payload []byte) []byte {
+    data := append([]byte(nil), frameMagic...)
+    data = append(data, byte(version), compressNone)
+    data = binary.BigEndian.AppendUint32(data, uint32(len(header)))
+    data = append(data, header...)
+    return append(data, payload...)
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+    stamp := time.Unix(1700000000, 123456789)
+    tests := []struct {
+        name string
+        msg  Message
+    }{
+        {"minimal text", Message{Type: "text", Content: "hi", Timestamp: stamp, SenderID: "a1"}},
+        {"empty content", Message{Type: "text", Timestamp: stamp, SenderID: "a1"}},
+        {"all fields", Message{
+            ID:        "0123456789abcdef",
+            Type:      "edit",
+            Content:   "fixed ✓",
+            Timestamp: stamp,
+            SenderID:  "a1",
+            Size:      42,
+            RefID:     "fedcba9876543210",
+            ReplyTo:   "1111222233334444",
+            Signature: []byte{1, 2, 3, 0, 255},
+            Clock:     1 << 40,
+            Priority:  PriorityAlert,
+            TTL:       90 * time.Second,
+        }},
+        {"file", Message{Type: "file", Content: "notes.txt", Data: []byte("line one\nline two\n"), Timestamp: stamp, SenderID: "a1", Size: 18}},
+        {"binary data", Message{Type: "file", Content: "blob", Data: []byte{0, 1, 2, 254, 255}, Timestamp: stamp, SenderID: "a1", Size: 5}},
+        {"negative size and time", Message{Type: "text", Timestamp: time.Unix(-5, 0), SenderID: "a1", Size: -1}},
+    }
+
+    for _, test := range tests {
+        for _, version := range []int{minProtocolVersion, binaryProtocol, protocolVersion} {
+            data, rawSize, err := encodeMessage(test.msg, version, false)
+            if err != nil {
+                t.Errorf("%s, protocol %d: encode: %v", test.name, version, err)
+                continue
+            }
+            if rawSize != len(data) {
+                t.Errorf("%s, protocol %d: raw size %d, frame is %d bytes", test.name, version, rawSize, len(data))
+            }
+            if version >= binaryProtocol && !bytes.HasPrefix(data, frameMagic) {
+                t.Errorf("%s, protocol %d: not a binary frame", test.name, version)
+            }
+
+            got, size, err := decodeMessage(data)
+            if err != nil {
+                t.Errorf("%s, protocol %d: decode: %v", test.name, version, err)
+                continue
+            }
+            if size != rawSize {
+                t.Errorf("%s, protocol %d: decoded size %d, want %d", test.name, version, size, rawSize)
+            }
+            want := test.msg
+            if version < binaryProtocol && want.Data == nil {
+                want.Data = got.Data // JSON has no way to tell nil from empty
+            }
+            if !sameMessage(got, want) {
+                t.Errorf("%s, protocol %d: got %+v, want %+v", test.name, version, got, want)
+            }
+        }
+    }
+}
+
+func TestDecodeSkipsUnknownFields(t *testing.T) {
+    var header []byte
+    header = appendField(header, tagType, []byte("text"))
+    header = appendField(header, 200, []byte("from a newer sender"))
+    header = appendField(header, tagContent, []byte("hi"))
+
+    msg, _, err := decodeMessage(frame(protocolVersion, header, nil))
+    if err != nil {
+        t.Fatalf("decode: %v", err)
+    }
+    if msg.Type != "text" || msg.Content != "hi" {
+        t.Errorf("got type %q content %q, want text and hi", msg.Type, msg.Content)
+    }
+}
+
+func TestDecodeMalformed(t *testing.T) {
+    good := appendField(nil, tagType, []byte("text"))
+    tests := []struct {
+        name string
+        data []byte
+        err  string
+    }{
+        {"short frame", []byte("NR\x02\x00\x00"), "frame too short"},
+        {"old version", frame(1, good, nil), "unsupported frame version 1"},
+        {"newer version", frame(protocolVersion+1, good, nil), "unsupported frame version"},
+        {"unknown compression", append([]byte("NR\x02\x07"), 0, 0, 0, 0), "unsupported compression 7"},
+        {"header longer than frame", frame(protocolVersion, good, nil)[:frameHeaderSize+len(good)-1], "frame header truncated"},
+        {"field longer than header", frame(protocolVersion, append(good, tagContent, 10, 'h', 'i'), nil), "malformed header field 2"},
+        {"field without length", frame(protocolVersion, append(good, tagContent), nil), "malformed header field 2"},
+        {"overlong length varint", frame(protocolVersion, append(good, tagContent, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01), nil), "malformed header field 2"},
+        {"empty timestamp", frame(protocolVersion, appendField(good, tagTimestamp, nil), nil), "malformed varint"},
+        {"truncated timestamp", frame(protocolVersion, appendField(good, tagTimestamp, []byte{0x80}), nil), "malformed varint"},
+        {"truncated size", frame(protocolVersion, appendField(good, tagSize, []byte{0xff}), nil), "malformed varint"},
+        {"truncated clock", frame(protocolVersion, appendField(good, tagClock, []byte{0x80}), nil), "malformed clock"},
+        {"truncated priority", frame(protocolVersion, appendField(good, tagPriority, nil), nil), "malformed varint"},
+        {"truncated ttl", frame(protocolVersion, appendField(good, tagTTL, []byte{0x80, 0x80}), nil), "malformed varint"},
+        {"bad json", []byte(`{"type":`), "unexpected end of JSON input"},
+    }
+
+    for _, test := range tests {
+        _, _, err := decodeMessage(test.data)
+        if err == nil || !strings.Contains(err.Error(), test.err) {
+            t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+        }
+    }
+}
+
+func TestEncodeOversized(t *testing.T) {
+    // The header encodeMessage writes for a file with no other fields
+    fileHeader := appendField(nil, tagType, []byte("file"))
+    fileHeader = appendField(fileHeader, tagContent, nil)
+    fileHeader = appendField(fileHeader, tagTimestamp, binary.AppendVarint(nil, time.Time{}.UnixNano()))
+    fileHeader = appendField(fileHeader, tagSenderID, nil)
+    fileHeader = appendField(fileHeader, tagSize, binary.AppendVarint(nil, 0))
+
+    tests := []struct {
+        name string
+        msg  Message
+        ok   bool
+    }{
+        {"largest file", Message{
+            ID:        "0123456789abcdef",
+            Type:      "file",
+            Content:   "/" + strings.Repeat("long/path/", 50) + "file.bin",
+            Data:      make([]byte, MaxFileSize),
+            Timestamp: time.Now(),
+            SenderID:  "fedcba9876543210",
+            Size:      MaxFileSize,
+            Clock:     1 << 40,
+            Priority:  PriorityAlert,
+            TTL:       time.Hour,
+        }, true},
+        {"fills the frame", Message{Type: "file", Data: make([]byte, maxFrameSize-frameHeaderSize-len(fileHeader))}, true},
+        {"one byte over", Message{Type: "file", Data: make([]byte, maxFrameSize-frameHeaderSize-len(fileHeader)+1)}, false},
+        {"content too large", Message{Type: "text", Content: strings.Repeat("x", maxFrameSize)}, false},
+        {"too large as JSON", Message{Type: "file", Data: make([]byte, MaxFileSize)}, false},
+    }
+
+    for _, test := range tests {
+        version := protocolVersion
+        if strings.HasSuffix(test.name, "JSON") {
+            version = minProtocolVersion
+        }
+        _, _, err := encodeMessage(test.msg, version, false)
+        if test.ok && err != nil {
+            t.Errorf("%s: %v", test.name, err)
+        }
+        if !test.ok && (err == nil || !strings.Contains(err.Error(), "message too large")) {
+            t.Errorf("%s: got error %v, want message too large", test.name, err)
+        }
+    }
+}
+
+// deflated builds a compressed frame whose body inflates to header and
+// payload.
+func deflated(header, payload []byte) []byte {
+    var buf bytes.Buffer
+    w, _ := flate.NewWriter(&buf, flate.BestCompression)
+    w.Write(header)
+    w.Write(payload)
+    w.Close()
+
+    data := append([]byte(nil), frameMagic...)
+    data = append(data, protocolVersion, compressDeflate)
+    data = binary.BigEndian.AppendUint32(data, uint32(len(header)))
+    return append(data, buf.Bytes()...)
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+    stamp := time.Unix(1700000000, 0)
+    tests := []struct {
+        name       string
+        msg        Message
+        compressed bool
+    }{
+        {"repetitive text", Message{Type: "text", Content: strings.Repeat("all quiet on the front ", 50), Timestamp: stamp, SenderID: "a1"}, true},
+        {"repetitive file", Message{Type: "file", Content: "log.txt", Data: bytes.Repeat([]byte("ok\n"), 10000), Timestamp: stamp, SenderID: "a1", Size: 30000}, true},
+        {"short text", Message{Type: "text", Content: "hi", Timestamp: stamp, SenderID: "a1"}, false},
+        {"random file", Message{Type: "file", Content: "key", Data: []byte{0x8f, 0x21, 0xc4, 0x07, 0x5e, 0xb2, 0x99, 0x3a}, Timestamp: stamp, SenderID: "a1", Size: 8}, false},
+    }
+
+    for _, test := range tests {
+        data, rawSize, err := encodeMessage(test.msg, protocolVersion, true)
+        if err != nil {
+            t.Errorf("%s: encode: %v", test.name, err)
+            continue
+        }
+        if compressed := data[3] == compressDeflate; compressed != test.compressed {
+            t.Errorf("%s: compressed %v, want %v", test.name, compressed, test.compressed)
+        }
+        if test.compressed && len(data) >= rawSize {
+            t.Errorf("%s: frame of %d bytes is not smaller than %d", test.name, len(data), rawSize)
+        }
+
+        got, size, err := decodeMessage(data)
+        if err != nil {
+            t.Errorf("%s: decode: %v", test.name, err)
+            continue
+        }
+        if size != rawSize {
+            t.Errorf("%s: decoded size %d, want %d", test.name, size, rawSize)
+        }
+        if !sameMessage(got, test.msg) {
+            t.Errorf("%s: got %+v, want %+v", test.name, got, test.msg)
+        }
+    }
+}
+
+func TestDecodeMalformedCompressed(t *testing.T) {
+    header := appendField(nil, tagType, []byte("file"))
+    tests := []struct {
+        name string
+        data []byte
+        err  string
+    }{
+        {"at the limit", deflated(header, make([]byte, maxFrameSize-frameHeaderSize-len(header))), ""},
+        {"one byte over", deflated(header, make([]byte, maxFrameSize-frameHeaderSize-len(header)+1)), "decompressed frame exceeds"},
+        {"bomb", deflated(header, make([]byte, 10*maxDatagram)), "decompressed frame exceeds"},
+        {"truncated stream", deflated(header, []byte("payload"))[:frameHeaderSize+3], "failed to decompress"},
+        {"not deflate", append([]byte("NR\x02\x01\x00\x00\x00\x00"), 0xff, 0xff, 0xff), "failed to decompress"},
+        {"header longer than body", deflated(header, nil)[:frameHeaderSize], "failed to decompress"},
+    }
+
+    for _, test := range tests {
+        _, _, err := decodeMessage(test.data)
+        switch {
+        case test.err == "" && err != nil:
+            t.Errorf("%s: %v", test.name, err)
+        case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+            t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+        }
+    }
+}
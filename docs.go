@@ -9,8 +9,26 @@ This file contains package documentation and usage examples.
 See BUILD.md and README.md for detailed documentation.
 
 Basic Usage:
-    messenger --gui     Start in GUI mode (if available)
-    messenger          Start in CLI mode
+    messenger -gui      Chat in the browser instead of the terminal
+    messenger          Start in CLI mode (full-screen in a terminal)
+    messenger -plain   Use the line-based CLI
+    messenger -nick alice        Show peers a nickname
+    messenger -peers peers.txt   Also probe the peers listed in peers.txt
+    messenger -message-port 0    Run beside another instance on this host
+    messenger -iface wlan0       Only broadcast beacons on wlan0
+    messenger send --to alice "Hello"   Send one message and exit
+    messenger file report.pdf           Send a file to every peer and exit
+    messenger peers --json              Print discovered peers as JSON
+    messenger listen                    Print incoming messages to stdout
+    messenger -json                     Newline-delimited JSON events on stdout
+    messenger -control ""               Do not listen on ~/.messenger.sock
+    messenger -http 127.0.0.1:8080      Serve the HTTP and WebSocket API
+    messenger -bot ping,status          Answer !ping and !status
+    messenger -hook ./responder.sh      Feed events to a script that can send
+
+The messenger itself is the messenger/core package (New, Start, Send,
+SendFile, Peers, Subscribe, Close); this package is its command-line,
+full-screen and web frontend.
 
 Example CLI Session:
     > help
@@ -18,12 +36,27 @@ Example CLI Session:
       help           - Show this help
       list           - List connected peers
       send <message> - Send text message
+      send --ttl 5m <msg> - Send a message receivers discard after 5 minutes
       file <path>    - Send file
+      connect <host:port> - Add a static peer and probe it
+      receipts [msg-id]   - Show who received and read a sent message
+      reply <id> <text>   - Reply to a message
+      edit <id> <text>    - Replace the text of a message you sent
+      retract <id>        - Withdraw a message you sent
+      history [n]         - Show the last n messages (default 20)
+      alert <message>     - Send a priority alert every peer must acknowledge
+      ack [id|all]        - Acknowledge received alerts (lists them without id)
+      presence [status]   - Show or set your status
       status         - Show network and statistics
       quit           - Exit the application
 
     > send "Hello World"
-    Message sent to all peers
+    Message 3f9a2c1b7e4d5a60 sent to 2 peers
+
+    > receipts 3f9a
+    Message 3f9a2c1b7e4d5a60 (text) sent 14:02:11: "Hello World"
+      5841e6fb508539ad: read 14:02:15
+      c411b680dbd6f6f4: delivered 14:02:11
 
     > file "/path/to/file.txt"
     Sending file to all peers...
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "fmt"
+
+    "messenger/core"
+)
+
+// statusChanged asks the CLI to redraw its status line and peer list.
+var statusChanged = make(chan struct{}, 1)
+
+func refreshStatus() {
+    select {
+    case statusChanged <- struct{}{}:
+    default:
+    }
+}
+
+// showEvents shows what arrives from the network through notify, and keeps
+// the status line current.
+func showEvents(m *core.Messenger, events <-chan core.Event) {
+    for event := range events {
+        switch e := event.(type) {
+        case core.TextReceived:
+            msg := e.Message
+            alert := msg.Priority >= core.PriorityAlert
+            if alert {
+                notifyAlert("ALERT from %s [%s]: %s\nType 'ack %s' to acknowledge",
+                    msg.SenderID, shortID(msg.ID), msg.Content, shortID(msg.ID))
+                break
+            }
+            reply := ""
+            if msg.ReplyTo != "" {
+                reply = fmt.Sprintf(" (reply to %s)", shortID(msg.ReplyTo))
+            }
+            if e.Late {
+                reply += " (arrived late, see history)"
+            }
+            if msg.TTL > 0 {
+                reply += fmt.Sprintf(" (expires in %s)", msg.TTL)
+            }
+            notify("Received from %s [%s]%s: %s", msg.SenderID, shortID(msg.ID), reply, msg.Content)
+
+        case core.FileReceived:
+            msg := e.Message
+            late := ""
+            if e.Late {
+                late = " (arrived late, see history)"
+            }
+            notify("Received file from %s [%s]%s: %s", msg.SenderID, shortID(msg.ID), late, e.Path)
+
+        case core.MessageEdited:
+            notify("Message [%s] from %s edited: %s", shortID(e.ID), e.SenderID, e.Content)
+
+        case core.MessageRetracted:
+            notify("Message [%s] from %s was retracted", shortID(e.ID), e.SenderID)
+
+        case core.PeerJoined, core.PeerLeft:
+            refreshStatus()
+
+        case core.PeerIncompatible:
+            notify("Warning: peer %s (v%s) is incompatible: %v", e.Peer.ID, e.Peer.Version, e.Err)
+
+        case core.QueuedMessageSent:
+            notify("Sent queued %s [%s] after %d attempts", e.Message.Type, shortID(e.Message.ID), e.Attempts)
+
+        case core.DeliveryFailed:
+            notify("Gave up on %s [%s] after %d attempts: %v",
+                e.Message.Type, shortID(e.Message.ID), e.Attempts, e.Err)
+
+        case core.AlertAcknowledged:
+            notify("Alert [%s] acknowledged by %s", shortID(e.ID), e.PeerID)
+
+        case core.TypingChanged:
+            refreshStatus()
+
+        case core.MessagesExpired:
+            clearExpiredFromScreen(m)
+        }
+    }
+}
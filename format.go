@@ -0,0 +1,215 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+
+    "messenger/core"
+)
+
+// shortID abbreviates a message ID for display; any unique prefix is
+// accepted wherever an ID is expected.
+func shortID(id string) string {
+    if len(id) > 8 {
+        return id[:8]
+    }
+    return id
+}
+
+func truncate(s string, n int) string {
+    r := []rune(s)
+    if len(r) <= n {
+        return s
+    }
+    return string(r[:n-1]) + "…"
+}
+
+func formatPresence(state, text string) string {
+    switch {
+    case state == "":
+        return core.PresenceAvailable
+    case state == core.PresenceCustom:
+        return fmt.Sprintf("%q", text)
+    case text != "":
+        return fmt.Sprintf("%s: %s", state, text)
+    }
+    return state
+}
+
+// presenceStatus is our own status as shown to the user.
+func presenceStatus(m *core.Messenger) string {
+    state, text, idle := m.Presence()
+    status := formatPresence(state, text)
+    if idle {
+        status += " (idle)"
+    }
+    return status
+}
+
+func getNetworkStatus(m *core.Messenger) string {
+    peerCount, activeCount := m.PeerCounts()
+    return fmt.Sprintf("Network Status: %d peers (%d active)", peerCount, activeCount)
+}
+
+// getStatusLine is the network status plus who is typing.
+func getStatusLine(m *core.Messenger) string {
+    status := getNetworkStatus(m)
+    switch peers := m.TypingPeers(); len(peers) {
+    case 0:
+    case 1:
+        status += fmt.Sprintf(" | %s is typing…", peers[0])
+    default:
+        status += fmt.Sprintf(" | %s are typing…", strings.Join(peers, ", "))
+    }
+    return status
+}
+
+// peerNames lists the IDs and nicknames of known peers, for completion.
+func peerNames(m *core.Messenger) []string {
+    var names []string
+    for _, peer := range m.Peers() {
+        names = append(names, peer.ID)
+        if peer.Nickname != "" {
+            names = append(names, peer.Nickname)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+// formatInterfaces reports each broadcast interface and how many peers
+// were found on it.
+func formatInterfaces(m *core.Messenger) string {
+    interfaces := m.Interfaces()
+
+    var b strings.Builder
+    b.WriteString("Interfaces:")
+    if len(interfaces) == 0 || interfaces[0].Network == nil {
+        b.WriteString("\n  none found, using 255.255.255.255")
+    }
+    for _, iface := range interfaces {
+        if iface.Network != nil {
+            fmt.Fprintf(&b, "\n  %-10s %-18s broadcast %-15s %d peers",
+                iface.Name, iface.Network, iface.Broadcast, iface.Peers)
+            continue
+        }
+        label := iface.Name
+        if label == "" {
+            label = "other"
+        }
+        fmt.Fprintf(&b, "\n  %-10s %d peers", label, iface.Peers)
+    }
+    return b.String()
+}
+
+// formatHistory formats the last n stored messages in causal order.
+func formatHistory(m *core.Messenger, n int) string {
+    entries := m.History(n)
+    if len(entries) == 0 {
+        return "No messages"
+    }
+
+    var b strings.Builder
+    b.WriteString("History:")
+    for _, entry := range entries {
+        b.WriteString("\n  ")
+        b.WriteString(formatHistoryEntry(entry, m.ID))
+    }
+    return b.String()
+}
+
+func formatHistoryEntry(entry core.HistoryEntry, selfID string) string {
+    sender := entry.SenderID
+    if sender == selfID {
+        sender = "me"
+    }
+
+    content := entry.Content
+    if entry.Type == "file" {
+        content = "file " + content
+    }
+    if entry.Priority >= core.PriorityAlert {
+        content = "ALERT " + content
+    }
+    switch {
+    case entry.Retracted:
+        content = "[retracted]"
+    case entry.Edited:
+        content += " (edited)"
+    }
+    if entry.Late {
+        content += " (arrived late)"
+    }
+    if !entry.ExpiresAt.IsZero() {
+        content += " (expires " + entry.ExpiresAt.Format("15:04:05") + ")"
+    }
+
+    reply := ""
+    if entry.ReplyTo != "" {
+        reply = fmt.Sprintf(" ↳ %s", shortID(entry.ReplyTo))
+    }
+    return fmt.Sprintf("%s [%s]%s %s: %s",
+        entry.Timestamp.Format("15:04:05"), shortID(entry.ID), reply, sender, content)
+}
+
+// formatReceipts describes who has received and read message id, or gives
+// a summary of recent sent messages when id is empty.
+func formatReceipts(m *core.Messenger, id string) (string, error) {
+    var b strings.Builder
+    if id == "" {
+        receipts := m.Receipts()
+        if len(receipts) == 0 {
+            return "No sent messages", nil
+        }
+        b.WriteString("Recent messages:")
+        for _, sent := range receipts {
+            delivered, read, acked := 0, 0, 0
+            for _, status := range sent.Recipients {
+                if !status.Delivered.IsZero() {
+                    delivered++
+                }
+                if !status.Read.IsZero() {
+                    read++
+                }
+                if !status.Acked.IsZero() {
+                    acked++
+                }
+            }
+            fmt.Fprintf(&b, "\n  %s %s %-24s delivered %d/%d, read %d/%d",
+                sent.ID, sent.SentAt.Format("15:04:05"), truncate(sent.Content, 24),
+                delivered, len(sent.Recipients), read, len(sent.Recipients))
+            if sent.Priority >= core.PriorityAlert {
+                fmt.Fprintf(&b, ", acknowledged %d/%d", acked, len(sent.Recipients))
+            }
+        }
+        return b.String(), nil
+    }
+
+    sent, err := m.Receipt(id)
+    if err != nil {
+        return "", err
+    }
+
+    peerIDs := make([]string, 0, len(sent.Recipients))
+    for peerID := range sent.Recipients {
+        peerIDs = append(peerIDs, peerID)
+    }
+    sort.Strings(peerIDs)
+
+    fmt.Fprintf(&b, "Message %s (%s) sent %s: %s",
+        sent.ID, sent.Type, sent.SentAt.Format("15:04:05"), truncate(sent.Content, 40))
+    for _, peerID := range peerIDs {
+        status := sent.Recipients[peerID]
+        state := "sent"
+        if !status.Acked.IsZero() {
+            state = "acknowledged " + status.Acked.Format("15:04:05")
+        } else if !status.Read.IsZero() {
+            state = "read " + status.Read.Format("15:04:05")
+        } else if !status.Delivered.IsZero() {
+            state = "delivered " + status.Delivered.Format("15:04:05")
+        }
+        fmt.Fprintf(&b, "\n  %s: %s", peerID, state)
+    }
+    return b.String(), nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "embed"
+    "fmt"
+    "io/fs"
+    "net/http"
+    "os"
+    "os/exec"
+    "os/signal"
+    "runtime"
+    "syscall"
+
+    "messenger/core"
+)
+
+// guiFiles is the web interface, built into the binary.
+//
+//go:embed gui
+var guiFiles embed.FS
+
+func guiHandler() http.Handler {
+    files, err := fs.Sub(guiFiles, "gui")
+    if err != nil {
+        panic(err)
+    }
+    return http.FileServerFS(files)
+}
+
+// runGUI runs the node behind the web interface at url until interrupted,
+// logging events to the terminal.
+func runGUI(messenger *core.Messenger, url string, browser bool) {
+    running.Store(true)
+    fmt.Printf("Your ID: %s\n", messenger.ID)
+    fmt.Printf("Web interface at %s, interrupt to stop\n", url)
+    if browser {
+        if err := openURL(url); err != nil {
+            fmt.Printf("Could not open a browser (%v), open the address above\n", err)
+        }
+    }
+
+    interrupt := make(chan os.Signal, 1)
+    signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+    <-interrupt
+    fmt.Println("Shutting down...")
+    running.Store(false)
+}
+
+// openURL shows url in the default browser.
+func openURL(url string) error {
+    var cmd *exec.Cmd
+    switch runtime.GOOS {
+    case "darwin":
+        cmd = exec.Command("open", url)
+    case "windows":
+        cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+    default:
+        cmd = exec.Command("xdg-open", url)
+    }
+    if err := cmd.Start(); err != nil {
+        return err
+    }
+    go cmd.Wait()
+    return nil
+}
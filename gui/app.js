@@ -0,0 +1,267 @@
+// Web interface for the messenger, talking to the node's HTTP API.
+'use strict';
+
+const $ = selector => document.querySelector(selector);
+let self = {};
+const nicknames = new Map(); // peer ID -> nickname
+const shown = new Map();     // message ID -> list item
+
+async function api(path, options) {
+  const response = await fetch(path, options);
+  if (response.status === 204) {
+    return null;
+  }
+  const body = await response.json();
+  if (!response.ok) {
+    throw new Error(body.error || response.statusText);
+  }
+  return body;
+}
+
+function postJSON(path, body) {
+  return api(path, {
+    method: 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify(body),
+  });
+}
+
+function name(id) {
+  if (id === self.id) {
+    return 'me';
+  }
+  return nicknames.get(id) || id;
+}
+
+function element(tag, className, text) {
+  const el = document.createElement(tag);
+  if (className) {
+    el.className = className;
+  }
+  if (text !== undefined) {
+    el.textContent = text;
+  }
+  return el;
+}
+
+// addMessage shows a sent or received message, file or alert.
+function addMessage(m) {
+  const list = $('#messages');
+  const atBottom = list.scrollTop + list.clientHeight >= list.scrollHeight - 5;
+  const time = new Date(m.time || Date.now()).toLocaleTimeString();
+
+  const item = element('li', m.from === self.id ? 'mine' : '');
+  if (m.alert) {
+    item.classList.add('alert');
+  }
+  item.append(element('span', 'meta', `${time} ${name(m.from)}`));
+  const text = m.type === 'file' ? `sent a file: ${m.content.split(/[\\/]/).pop()}` : m.content;
+  item.append(element('span', 'text', m.alert ? `ALERT ${text}` : text));
+  item.append(element('span', 'note'));
+  if (m.alert && m.from !== self.id) {
+    const ack = element('button', '', 'Acknowledge');
+    ack.onclick = () => postJSON('/api/ack', {id: m.id})
+      .then(() => ack.remove())
+      .catch(err => notice(`Acknowledging failed: ${err.message}`));
+    item.append(ack);
+  }
+  if (m.id) {
+    shown.set(m.id, item);
+  }
+  if (m.edited) {
+    setNote(item, 'edited');
+  }
+  if (m.retracted) {
+    retract(item);
+  }
+  if (m.expiresInSeconds > 0) {
+    setTimeout(() => item.remove(), m.expiresInSeconds * 1000);
+  }
+  list.append(item);
+  if (atBottom) {
+    list.scrollTop = list.scrollHeight;
+  }
+  return item;
+}
+
+function notice(text) {
+  const item = element('li', 'notice', text);
+  $('#messages').append(item);
+  $('#messages').scrollTop = $('#messages').scrollHeight;
+}
+
+function setNote(item, text) {
+  item.querySelector('.note').textContent = text;
+}
+
+function retract(item) {
+  item.classList.add('retracted');
+  item.querySelector('.text').textContent = '[retracted]';
+}
+
+function reportDelivery(item, result) {
+  setNote(item, `delivered to ${result.delivered}/${result.recipients}`);
+}
+
+function handleEvent(event) {
+  switch (event.event) {
+  case 'message':
+    addMessage({...event, type: 'text', expiresInSeconds: event.ttlSeconds});
+    break;
+  case 'file':
+    addMessage({...event, type: 'file', content: event.name});
+    break;
+  case 'edited': {
+    const item = shown.get(event.id);
+    if (item) {
+      item.querySelector('.text').textContent = event.content;
+      setNote(item, 'edited');
+    }
+    break;
+  }
+  case 'retracted': {
+    const item = shown.get(event.id);
+    if (item) {
+      retract(item);
+    }
+    break;
+  }
+  case 'peer_joined':
+    notice(`${event.peer.nickname || event.peer.id} joined`);
+    refreshPeers();
+    break;
+  case 'peer_left':
+    notice(`${event.peer.nickname || event.peer.id} left`);
+    refreshPeers();
+    break;
+  case 'expired':
+    for (const id of event.ids) {
+      shown.get(id)?.remove();
+      shown.delete(id);
+    }
+    break;
+  case 'delivery_failed':
+    notice(`Gave up on ${event.type} ${event.id.slice(0, 8)}: ${event.error}`);
+    break;
+  }
+  if (document.hasFocus()) {
+    markRead();
+  }
+}
+
+async function refreshPeers() {
+  const peers = await api('/api/peers');
+  const list = $('#peers');
+  const select = $('#to');
+  const selected = select.value;
+  list.replaceChildren();
+  select.replaceChildren(new Option('All peers', ''));
+
+  for (const peer of peers) {
+    if (peer.nickname) {
+      nicknames.set(peer.id, peer.nickname);
+    }
+    const active = Date.now() - new Date(peer.lastSeen) < 10000;
+    const item = element('li', active ? '' : 'stale');
+    item.append(element('span', '', `${active ? '●' : '○'} ${peer.nickname || peer.id} `));
+    let presence = peer.presence || '';
+    if (peer.presenceText) {
+      presence += `: ${peer.presenceText}`;
+    }
+    if (!peer.compatible) {
+      presence += ' (incompatible)';
+    }
+    item.append(element('span', 'presence', presence));
+    item.title = `${peer.id} at ${peer.address}`;
+    list.append(item);
+    select.append(new Option(peer.nickname || peer.id, peer.id));
+  }
+  select.value = selected;
+}
+
+async function refreshStatus() {
+  const stats = await api('/api/stats');
+  self = stats;
+  $('#self').textContent = stats.nickname ? `${stats.nickname} (${stats.id})` : stats.id;
+  $('#status').textContent = `${stats.activePeers} active peers · ` +
+    `${stats.messagesSent} sent · ${stats.messagesReceived} received · ` +
+    `${stats.filesSent + stats.filesReceived} files`;
+}
+
+function markRead() {
+  postJSON('/api/read', {}).catch(() => {});
+}
+
+function connectEvents() {
+  const socket = new WebSocket(`ws://${location.host}/api/events`);
+  socket.onmessage = message => handleEvent(JSON.parse(message.data));
+  socket.onclose = () => {
+    $('#status').textContent = 'Disconnected, retrying…';
+    setTimeout(connectEvents, 2000);
+  };
+}
+
+$('#compose').onsubmit = async event => {
+  event.preventDefault();
+  const text = $('#text').value.trim();
+  if (!text) {
+    return;
+  }
+  $('#text').value = '';
+  const item = addMessage({from: self.id, type: 'text', content: text});
+  setNote(item, 'sending…');
+  try {
+    reportDelivery(item, await postJSON('/api/send', {text, to: $('#to').value}));
+  } catch (err) {
+    setNote(item, `not sent: ${err.message}`);
+  }
+  markRead();
+};
+
+async function sendFile(file) {
+  const item = addMessage({from: self.id, type: 'file', content: file.name});
+  setNote(item, 'sending…');
+  const form = new FormData();
+  form.append('file', file);
+  form.append('to', $('#to').value);
+  try {
+    reportDelivery(item, await api('/api/file', {method: 'POST', body: form}));
+  } catch (err) {
+    setNote(item, `not sent: ${err.message}`);
+  }
+}
+
+let dragDepth = 0;
+document.addEventListener('dragenter', event => {
+  event.preventDefault();
+  dragDepth++;
+  document.body.classList.add('dragging');
+});
+document.addEventListener('dragleave', () => {
+  if (--dragDepth === 0) {
+    document.body.classList.remove('dragging');
+  }
+});
+document.addEventListener('dragover', event => event.preventDefault());
+document.addEventListener('drop', event => {
+  event.preventDefault();
+  dragDepth = 0;
+  document.body.classList.remove('dragging');
+  for (const file of event.dataTransfer.files) {
+    sendFile(file);
+  }
+});
+window.addEventListener('focus', markRead);
+
+async function start() {
+  await refreshStatus();
+  await refreshPeers();
+  for (const entry of await api('/api/history')) {
+    addMessage(entry);
+  }
+  connectEvents();
+  setInterval(() => refreshPeers().catch(() => {}), 5000);
+  setInterval(() => refreshStatus().catch(() => {}), 5000);
+}
+
+start().catch(err => notice(`Cannot reach the messenger: ${err.message}`));
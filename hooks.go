@@ -0,0 +1,153 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "sync"
+
+    "messenger/core"
+)
+
+// builtinHooks are the responders -bot can turn on.
+var builtinHooks = map[string]func() core.Hook{
+    "ping":   core.PingHook,
+    "status": core.StatusHook,
+}
+
+// hookList collects the executables given with -hook, which may be
+// repeated.
+type hookList []string
+
+func (l *hookList) String() string {
+    return strings.Join(*l, ",")
+}
+
+func (l *hookList) Set(path string) error {
+    *l = append(*l, path)
+    return nil
+}
+
+// startHooks turns on the built-in responders named in bots and starts
+// every executable hook, and returns a function that stops them.
+func startHooks(m *core.Messenger, bots string, paths []string) (func(), error) {
+    var stops []func()
+    stopAll := func() {
+        for _, stop := range stops {
+            stop()
+        }
+    }
+
+    for _, name := range strings.Split(bots, ",") {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            continue
+        }
+        hook, ok := builtinHooks[name]
+        if !ok {
+            stopAll()
+            return nil, fmt.Errorf("unknown bot %q (have ping, status)", name)
+        }
+        stops = append(stops, m.AddHook(name, hook()))
+    }
+
+    for _, path := range paths {
+        stop, err := startExecHook(m, path)
+        if err != nil {
+            stopAll()
+            return nil, fmt.Errorf("hook %s: %v", path, err)
+        }
+        stops = append(stops, stop)
+    }
+    return stopAll, nil
+}
+
+// execHook is an executable fed every event as a line of JSON on stdin, as
+// written by -json. Each line it prints is a control socket request, and
+// the event answering it is written to its stdin in turn.
+type execHook struct {
+    name  string
+    mutex sync.Mutex // keeps events and answers from interleaving
+    stdin io.WriteCloser
+}
+
+// startExecHook runs the executable at path as a hook, and returns a
+// function that closes its stdin to ask it to exit.
+func startExecHook(m *core.Messenger, path string) (func(), error) {
+    cmd := exec.Command(path)
+    stdin, err := cmd.StdinPipe()
+    if err != nil {
+        return nil, err
+    }
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return nil, err
+    }
+    stderr, err := cmd.StderrPipe()
+    if err != nil {
+        return nil, err
+    }
+    if err := cmd.Start(); err != nil {
+        return nil, err
+    }
+
+    h := &execHook{name: filepath.Base(path), stdin: stdin}
+    stop := m.AddHook(h.name, h)
+
+    // What the hook reports goes where other notifications go
+    go func() {
+        scanner := bufio.NewScanner(stderr)
+        for scanner.Scan() {
+            notify("Hook %s: %s", h.name, scanner.Text())
+        }
+    }()
+
+    go func() {
+        scanner := bufio.NewScanner(stdout)
+        scanner.Buffer(nil, maxControlLine)
+        for scanner.Scan() {
+            var req controlRequest
+            var answer interface{}
+            switch err := json.Unmarshal(scanner.Bytes(), &req); {
+            case err != nil:
+                answer = errorEvent{header("error"), fmt.Sprintf("invalid request: %v", err)}
+            case req.Command == "subscribe":
+                answer = errorEvent{header("error"), "hooks receive every event already"}
+            default:
+                answer = answerControl(m, req)
+            }
+            if err := h.write(answer); err != nil {
+                break
+            }
+        }
+        stop()
+        if err := cmd.Wait(); err != nil {
+            notify("Hook %s exited: %v", h.name, err)
+        }
+    }()
+
+    return func() { stdin.Close() }, nil
+}
+
+func (h *execHook) HandleEvent(m *core.Messenger, e core.Event) error {
+    event := jsonEvent(e)
+    if event == nil {
+        return nil
+    }
+    return h.write(event)
+}
+
+func (h *execHook) write(event interface{}) error {
+    data, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    _, err = h.stdin.Write(append(data, '\n'))
+    return err
+}
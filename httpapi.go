@@ -0,0 +1,470 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+
+    "messenger/core"
+)
+
+const (
+    websocketGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+    maxWebSocketFrame = 1 << 16 // largest frame accepted from a client, which only sends control frames
+
+    wsText  = 0x1
+    wsClose = 0x8
+    wsPing  = 0x9
+    wsPong  = 0xA
+)
+
+// historyItem is a stored message as served by GET /api/history.
+type historyItem struct {
+    ID        string    `json:"id"`
+    From      string    `json:"from"`
+    Type      string    `json:"type"`
+    Content   string    `json:"content"`
+    ReplyTo   string    `json:"replyTo,omitempty"`
+    Time      time.Time `json:"time"`
+    Alert     bool      `json:"alert,omitempty"`
+    Edited    bool      `json:"edited,omitempty"`
+    Retracted bool      `json:"retracted,omitempty"`
+    ExpiresIn float64   `json:"expiresInSeconds,omitempty"`
+}
+
+// startHTTP serves the HTTP API on addr, which must be a loopback address,
+// with the web interface at / if gui is set. API requests must carry the
+// random token written to tokenFile, see requireToken. It returns the URL
+// of the web interface, which logs the browser in, and a function that
+// stops serving:
+//
+//   GET  /api/peers   peers as a JSON array
+//   GET  /api/stats   the stats event
+//   GET  /api/history stored messages, oldest first
+//   POST /api/send    {"text","to","ttl","timeout"}, answered with a delivery event
+//   POST /api/file    multipart form with file, and optionally to and timeout
+//   POST /api/read    send read receipts for everything received so far
+//   POST /api/ack     {"id"} acknowledges an alert, "all" every alert
+//   GET  /api/events  WebSocket stream of every event
+func startHTTP(m *core.Messenger, addr, tokenFile string, gui bool) (string, func(), error) {
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return "", nil, err
+    }
+    if !isLoopback(host) {
+        return "", nil, fmt.Errorf("must listen on localhost, not %s", host)
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("GET /api/peers", func(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, http.StatusOK, m.Peers())
+    })
+    mux.HandleFunc("GET /api/stats", func(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, http.StatusOK, newStatsEvent(m))
+    })
+    mux.HandleFunc("GET /api/history", func(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, http.StatusOK, historyItems(m))
+    })
+    mux.HandleFunc("POST /api/send", func(w http.ResponseWriter, r *http.Request) {
+        handleHTTPSend(m, w, r)
+    })
+    mux.HandleFunc("POST /api/file", func(w http.ResponseWriter, r *http.Request) {
+        handleHTTPFile(m, w, r)
+    })
+    mux.HandleFunc("POST /api/read", func(w http.ResponseWriter, r *http.Request) {
+        m.MarkAllRead()
+        w.WriteHeader(http.StatusNoContent)
+    })
+    mux.HandleFunc("POST /api/ack", func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            ID string `json:"id"`
+        }
+        if err := json.NewDecoder(io.LimitReader(r.Body, maxControlLine)).Decode(&req); err != nil || req.ID == "" {
+            writeError(w, http.StatusBadRequest, fmt.Errorf("expected {\"id\": ...}"))
+            return
+        }
+        if len(m.AcknowledgeAlerts(req.ID)) == 0 {
+            writeError(w, http.StatusNotFound, fmt.Errorf("no pending alert with ID %s", req.ID))
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    })
+    mux.HandleFunc("GET /api/events", serveWebSocketEvents)
+    if gui {
+        mux.Handle("GET /", guiHandler())
+    }
+
+    token, err := newToken()
+    if err != nil {
+        return "", nil, err
+    }
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return "", nil, err
+    }
+    if tokenFile != "" {
+        if err := os.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+            ln.Close()
+            return "", nil, err
+        }
+    }
+
+    _, port, _ := net.SplitHostPort(ln.Addr().String())
+    srv := &http.Server{Handler: localOnly(requireToken(token, "messenger_token_"+port, mux))}
+    go srv.Serve(ln)
+    stop := func() {
+        srv.Close()
+        // Leave the file alone if another node has replaced it since
+        if data, err := os.ReadFile(tokenFile); err == nil && strings.TrimSpace(string(data)) == token {
+            os.Remove(tokenFile)
+        }
+    }
+    return "http://" + ln.Addr().String() + "/?token=" + token, stop, nil
+}
+
+// defaultTokenFile is where the HTTP API token is written for local
+// scripts unless -http-token-file names another path.
+func defaultTokenFile() string {
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(home, ".messenger-http-token")
+}
+
+func newToken() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+// requireToken refuses API requests without the token, given as
+// "Authorization: Bearer <token>" or in the cookie named cookie. Opening
+// any page with ?token=<token> sets the cookie, so the web interface needs
+// only the URL it was opened with. The pages themselves are served to
+// anyone; they hold no data.
+func requireToken(token, cookie string, next http.Handler) http.Handler {
+    valid := func(s string) bool {
+        return subtle.ConstantTimeCompare([]byte(s), []byte(token)) == 1
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if t := r.URL.Query().Get("token"); t != "" && !strings.HasPrefix(r.URL.Path, "/api/") {
+            if !valid(t) {
+                writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+                return
+            }
+            http.SetCookie(w, &http.Cookie{Name: cookie, Value: token, Path: "/",
+                HttpOnly: true, SameSite: http.SameSiteStrictMode})
+            http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+            return
+        }
+
+        if strings.HasPrefix(r.URL.Path, "/api/") {
+            auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+            if c, err := r.Cookie(cookie); !ok && err == nil {
+                auth, ok = c.Value, true
+            }
+            if !ok || !valid(auth) {
+                writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid token"))
+                return
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// historyItems lists the stored messages in causal order.
+func historyItems(m *core.Messenger) []historyItem {
+    items := []historyItem{}
+    for _, entry := range m.History(0) {
+        item := historyItem{
+            ID:        entry.ID,
+            From:      entry.SenderID,
+            Type:      entry.Type,
+            Content:   entry.Content,
+            ReplyTo:   entry.ReplyTo,
+            Time:      entry.Timestamp,
+            Alert:     entry.Priority >= core.PriorityAlert,
+            Edited:    entry.Edited,
+            Retracted: entry.Retracted,
+        }
+        if !entry.ExpiresAt.IsZero() {
+            item.ExpiresIn = time.Until(entry.ExpiresAt).Seconds()
+        }
+        items = append(items, item)
+    }
+    return items
+}
+
+func isLoopback(host string) bool {
+    if host == "localhost" {
+        return true
+    }
+    ip := net.ParseIP(host)
+    return ip != nil && ip.IsLoopback()
+}
+
+// localOnly rejects requests that name another host, as after DNS
+// rebinding, and requests from pages served elsewhere, so websites open in
+// a browser cannot send through the node.
+func localOnly(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host := r.Host
+        if h, _, err := net.SplitHostPort(r.Host); err == nil {
+            host = h
+        }
+        if !isLoopback(host) {
+            writeError(w, http.StatusForbidden, fmt.Errorf("host %s not allowed", r.Host))
+            return
+        }
+        if origin := r.Header.Get("Origin"); origin != "" {
+            u, err := url.Parse(origin)
+            if err != nil || u.Host != r.Host {
+                writeError(w, http.StatusForbidden, fmt.Errorf("origin %s not allowed", origin))
+                return
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+    writeJSON(w, status, errorEvent{header("error"), err.Error()})
+}
+
+func handleHTTPSend(m *core.Messenger, w http.ResponseWriter, r *http.Request) {
+    var req controlRequest
+    if err := json.NewDecoder(io.LimitReader(r.Body, maxControlLine)).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+        return
+    }
+    req.Command = "send"
+    result, err := controlSend(m, req)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, result)
+}
+
+// handleHTTPFile sends an uploaded file. It is stored in a temporary
+// directory under its own name, which is the name receivers see.
+func handleHTTPFile(m *core.Messenger, w http.ResponseWriter, r *http.Request) {
+    // Files must fit in one frame, so larger uploads are refused unread
+    const maxUpload = core.MaxFileSize + 64<<10 // room for the form around the file
+    tooLarge := fmt.Errorf("file too large (max: %d bytes)", core.MaxFileSize)
+    if r.ContentLength > maxUpload {
+        writeError(w, http.StatusRequestEntityTooLarge, tooLarge)
+        return
+    }
+    r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+    file, fileHeader, err := r.FormFile("file")
+    var maxBytesErr *http.MaxBytesError
+    if errors.As(err, &maxBytesErr) {
+        writeError(w, http.StatusRequestEntityTooLarge, tooLarge)
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("no file uploaded: %v", err))
+        return
+    }
+    defer file.Close()
+    if fileHeader.Size > core.MaxFileSize {
+        writeError(w, http.StatusRequestEntityTooLarge, tooLarge)
+        return
+    }
+
+    dir, err := os.MkdirTemp("", "messenger-upload")
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    defer os.RemoveAll(dir)
+
+    name := filepath.Base(filepath.Clean("/" + fileHeader.Filename))
+    if name == "/" || name == "\\" {
+        name = "upload"
+    }
+    path := filepath.Join(dir, name)
+    f, err := os.Create(path)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    _, err = io.Copy(f, file)
+    f.Close()
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+
+    result, err := controlSend(m, controlRequest{
+        Command: "file",
+        Path:    path,
+        To:      r.FormValue("to"),
+        Timeout: r.FormValue("timeout"),
+    })
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, result)
+}
+
+// serveWebSocketEvents upgrades the request to a WebSocket and sends every
+// event as a text message until the client closes it.
+func serveWebSocketEvents(w http.ResponseWriter, r *http.Request) {
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("expected a WebSocket upgrade"))
+        return
+    }
+    hijacker, ok := w.(http.Hijacker)
+    if !ok {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("connection cannot be upgraded"))
+        return
+    }
+    conn, rw, err := hijacker.Hijack()
+    if err != nil {
+        return
+    }
+    defer conn.Close()
+
+    sum := sha1.Sum([]byte(key + websocketGUID))
+    fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+        "Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+        "Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+    if err := rw.Flush(); err != nil {
+        return
+    }
+
+    ch := subscribe()
+    defer unsubscribe(ch)
+
+    var writeMutex sync.Mutex
+    send := func(opcode byte, payload []byte) error {
+        writeMutex.Lock()
+        defer writeMutex.Unlock()
+        return writeFrame(conn, opcode, payload)
+    }
+
+    // Answer pings and notice when the client closes the connection
+    gone := make(chan struct{})
+    go func() {
+        defer close(gone)
+        for {
+            opcode, payload, err := readFrame(rw.Reader)
+            if err != nil {
+                return
+            }
+            switch opcode {
+            case wsClose:
+                send(wsClose, payload)
+                return
+            case wsPing:
+                send(wsPong, payload)
+            }
+        }
+    }()
+
+    for {
+        select {
+        case line, ok := <-ch:
+            if !ok {
+                return
+            }
+            if err := send(wsText, bytes.TrimSuffix(line, []byte("\n"))); err != nil {
+                return
+            }
+        case <-gone:
+            return
+        }
+    }
+}
+
+// writeFrame writes one unfragmented, unmasked WebSocket frame.
+func writeFrame(w io.Writer, opcode byte, payload []byte) error {
+    frame := []byte{0x80 | opcode}
+    switch n := len(payload); {
+    case n < 126:
+        frame = append(frame, byte(n))
+    case n <= 0xFFFF:
+        frame = append(frame, 126)
+        frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+    default:
+        frame = append(frame, 127)
+        frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+    }
+    _, err := w.Write(append(frame, payload...))
+    return err
+}
+
+// readFrame reads one WebSocket frame from a client and unmasks it.
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+    var head [2]byte
+    if _, err := io.ReadFull(r, head[:]); err != nil {
+        return 0, nil, err
+    }
+    opcode := head[0] & 0x0F
+    length := uint64(head[1] & 0x7F)
+    switch length {
+    case 126:
+        var ext [2]byte
+        if _, err := io.ReadFull(r, ext[:]); err != nil {
+            return 0, nil, err
+        }
+        length = uint64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        if _, err := io.ReadFull(r, ext[:]); err != nil {
+            return 0, nil, err
+        }
+        length = binary.BigEndian.Uint64(ext[:])
+    }
+    if length > maxWebSocketFrame {
+        return 0, nil, fmt.Errorf("WebSocket frame too large: %d bytes", length)
+    }
+
+    var mask [4]byte
+    masked := head[1]&0x80 != 0
+    if masked {
+        if _, err := io.ReadFull(r, mask[:]); err != nil {
+            return 0, nil, err
+        }
+    }
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(r, payload); err != nil {
+        return 0, nil, err
+    }
+    if masked {
+        for i := range payload {
+            payload[i] ^= mask[i%4]
+        }
+    }
+    return opcode, payload, nil
+}
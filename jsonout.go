@@ -0,0 +1,249 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "messenger/core"
+)
+
+// jsonOutput is set by -json: stdout then carries one JSON event per line
+// for other tools, and human-readable output goes to stderr.
+var jsonOutput bool
+
+var jsonMutex sync.Mutex // keeps events from interleaving
+
+// eventHeader starts every -json event.
+type eventHeader struct {
+    Event string    `json:"event"`
+    Time  time.Time `json:"time"`
+}
+
+func header(event string) eventHeader {
+    return eventHeader{Event: event, Time: time.Now()}
+}
+
+// startedEvent is emitted once the node runs.
+type startedEvent struct {
+    eventHeader
+    ID          string `json:"id"`
+    MessagePort int    `json:"messagePort"`
+}
+
+// messageEvent is a received text message or alert.
+type messageEvent struct {
+    eventHeader
+    ID         string  `json:"id"`
+    From       string  `json:"from"`
+    Content    string  `json:"content"`
+    ReplyTo    string  `json:"replyTo,omitempty"`
+    TTLSeconds float64 `json:"ttlSeconds,omitempty"`
+    Alert      bool    `json:"alert,omitempty"`
+    Late       bool    `json:"late,omitempty"` // a reply to it was shown first
+}
+
+// editEvent is an edit ("edited") or retraction ("retracted") of a
+// received message.
+type editEvent struct {
+    eventHeader
+    ID      string `json:"id"`
+    From    string `json:"from"`
+    Content string `json:"content,omitempty"`
+}
+
+// fileEvent is a received file, saved at Path.
+type fileEvent struct {
+    eventHeader
+    ID   string `json:"id"`
+    From string `json:"from"`
+    Name string `json:"name"`
+    Path string `json:"path"`
+    Size int64  `json:"size"`
+    Late bool   `json:"late,omitempty"`
+}
+
+// peerEvent is a peer joining ("peer_joined") or leaving ("peer_left").
+type peerEvent struct {
+    eventHeader
+    Peer core.PeerInfo `json:"peer"`
+}
+
+// peersEvent answers the list command.
+type peersEvent struct {
+    eventHeader
+    Peers []core.PeerInfo `json:"peers"`
+}
+
+// sentEvent reports a message or file handed to the network by a command.
+type sentEvent struct {
+    eventHeader
+    ID         string `json:"id"`
+    Type       string `json:"type"`
+    Recipients int    `json:"recipients"`
+    Queued     bool   `json:"queued,omitempty"` // no peers, retried later
+}
+
+// deliveryEvent is the result of the send and file subcommands.
+type deliveryEvent struct {
+    eventHeader
+    ID         string   `json:"id"`
+    Type       string   `json:"type"`
+    Delivered  int      `json:"delivered"`
+    Recipients int      `json:"recipients"`
+    Problems   []string `json:"problems,omitempty"` // peers that failed or did not confirm
+}
+
+// expiredEvent lists ephemeral messages whose TTL passed, which consumers
+// should delete.
+type expiredEvent struct {
+    eventHeader
+    IDs []string `json:"ids"`
+}
+
+// failedEvent is a queued message given up on.
+type failedEvent struct {
+    eventHeader
+    ID       string `json:"id"`
+    Type     string `json:"type"`
+    Attempts int    `json:"attempts"`
+    Error    string `json:"error"`
+}
+
+// statsEvent answers the status command.
+type statsEvent struct {
+    eventHeader
+    ID                string `json:"id"`
+    Nickname          string `json:"nickname,omitempty"`
+    Presence          string `json:"presence"`
+    Peers             int    `json:"peers"`
+    ActivePeers       int    `json:"activePeers"`
+    UptimeSeconds     int64  `json:"uptimeSeconds"`
+    MessagesSent      int64  `json:"messagesSent"`
+    MessagesReceived  int64  `json:"messagesReceived"`
+    FilesSent         int64  `json:"filesSent"`
+    FilesReceived     int64  `json:"filesReceived"`
+    BytesSent         int64  `json:"bytesSent"`
+    BytesReceived     int64  `json:"bytesReceived"`
+    RawBytesSent      int64  `json:"rawBytesSent"`
+    WireBytesSent     int64  `json:"wireBytesSent"`
+    RawBytesReceived  int64  `json:"rawBytesReceived"`
+    WireBytesReceived int64  `json:"wireBytesReceived"`
+    Duplicates        int64  `json:"duplicates"`
+}
+
+func newStatsEvent(m *core.Messenger) statsEvent {
+    total, active := m.PeerCounts()
+    stats := m.Stats()
+    return statsEvent{
+        eventHeader:       header("stats"),
+        ID:                m.ID,
+        Nickname:          m.Nickname(),
+        Presence:          presenceStatus(m),
+        Peers:             total,
+        ActivePeers:       active,
+        UptimeSeconds:     int64(time.Since(stats.StartTime).Seconds()),
+        MessagesSent:      stats.MessagesSent,
+        MessagesReceived:  stats.MessagesRecvd,
+        FilesSent:         stats.FilesSent,
+        FilesReceived:     stats.FilesRecvd,
+        BytesSent:         stats.BytesSent,
+        BytesReceived:     stats.BytesReceived,
+        RawBytesSent:      stats.RawBytesSent,
+        WireBytesSent:     stats.WireBytesSent,
+        RawBytesReceived:  stats.RawBytesRecvd,
+        WireBytesReceived: stats.WireBytesRecvd,
+        Duplicates:        stats.Duplicates,
+    }
+}
+
+// emitEvents converts what arrives from the network to JSON events.
+func emitEvents(events <-chan core.Event) {
+    for event := range events {
+        if e := jsonEvent(event); e != nil {
+            emit(e)
+        }
+    }
+}
+
+// jsonEvent is the JSON event for e, or nil if it has none.
+func jsonEvent(event core.Event) interface{} {
+    switch e := event.(type) {
+    case core.TextReceived:
+        msg := e.Message
+        return messageEvent{header("message"), msg.ID, msg.SenderID, msg.Content,
+            msg.ReplyTo, msg.TTL.Seconds(), msg.Priority >= core.PriorityAlert, e.Late}
+
+    case core.FileReceived:
+        msg := e.Message
+        return fileEvent{header("file"), msg.ID, msg.SenderID, filepath.Base(msg.Content),
+            e.Path, msg.Size, e.Late}
+
+    case core.MessageEdited:
+        return editEvent{header("edited"), e.ID, e.SenderID, e.Content}
+
+    case core.MessageRetracted:
+        return editEvent{header("retracted"), e.ID, e.SenderID, ""}
+
+    case core.PeerJoined:
+        return peerEvent{header("peer_joined"), e.Peer}
+
+    case core.PeerLeft:
+        return peerEvent{header("peer_left"), e.Peer}
+
+    case core.MessagesExpired:
+        return expiredEvent{header("expired"), e.IDs}
+
+    case core.DeliveryFailed:
+        return failedEvent{header("delivery_failed"), e.Message.ID, e.Message.Type,
+            e.Attempts, e.Err.Error()}
+    }
+    return nil
+}
+
+// emit writes an event as one line of JSON in -json mode, and passes it
+// to control socket subscribers.
+func emit(event interface{}) {
+    if !jsonOutput && !hasSubscribers() {
+        return
+    }
+    data, err := json.Marshal(event)
+    if err != nil {
+        log.Printf("Error encoding event: %v", err)
+        return
+    }
+    line := append(data, '\n')
+    publish(line)
+    if jsonOutput {
+        jsonMutex.Lock()
+        defer jsonMutex.Unlock()
+        os.Stdout.Write(line)
+    }
+}
+
+// runJSONCommands reads commands from stdin like line mode, without the
+// splash screen, prompt and status line that would corrupt the event
+// stream. It returns at end of input or on quit.
+func runJSONCommands(messenger *core.Messenger, onInput func()) {
+    emit(startedEvent{header("started"), messenger.ID, messenger.MessagePort()})
+
+    scanner := bufio.NewScanner(os.Stdin)
+    for scanner.Scan() {
+        onInput()
+        input := scanner.Text()
+        messenger.MarkAllRead()
+        if err := validateCommand(input); err != nil {
+            fmt.Fprintf(out, "Error: %v\n", err)
+            continue
+        }
+        if !runCommand(messenger, input) {
+            break
+        }
+    }
+    running.Store(false)
+}
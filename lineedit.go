@@ -0,0 +1,334 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "unicode"
+    "unicode/utf8"
+)
+
+const maxHistoryLines = 1000 // commands kept for recall, in memory and on disk
+
+// lineEditor is a readline-style input line with command history and tab
+// completion, used by both the full-screen interface and line mode.
+type lineEditor struct {
+    mu       sync.Mutex
+    buf      []rune
+    cursor   int
+    history  []string
+    histPos  int    // history entry being edited, len(history) for a new line
+    draft    string // the new line, kept while browsing history
+    histFile string // "" keeps history in memory only
+    complete completer
+}
+
+// completer returns the candidates for the word ending at rune offset pos
+// of line, and the offset where that word starts.
+type completer func(line string, pos int) (int, []string)
+
+// defaultHistoryFile is where command history is kept unless -history
+// names another file.
+func defaultHistoryFile() string {
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(home, ".messenger_history")
+}
+
+// errInterrupted is returned by readLine when Ctrl-C is pressed.
+var errInterrupted = errors.New("interrupted")
+
+// lineInput is the editor reading commands in line mode, nil otherwise.
+var lineInput atomic.Pointer[lineEditor]
+
+// newLineEditor loads the command history from histFile, if set.
+func newLineEditor(histFile string, complete completer) *lineEditor {
+    e := &lineEditor{histFile: histFile, complete: complete}
+    if histFile != "" {
+        // Files written by older versions may hold message text
+        rewrite := false
+        if data, err := os.ReadFile(histFile); err == nil {
+            for _, line := range strings.Split(string(data), "\n") {
+                if isMessageCommand(line) {
+                    rewrite = true
+                } else if line != "" {
+                    e.history = append(e.history, line)
+                }
+            }
+        }
+        // Keep the file from growing without bound
+        if len(e.history) > maxHistoryLines {
+            e.history = e.history[len(e.history)-maxHistoryLines:]
+            rewrite = true
+        }
+        if rewrite {
+            os.WriteFile(histFile, []byte(strings.Join(e.history, "\n")+"\n"), 0600)
+        }
+    }
+    e.histPos = len(e.history)
+    return e
+}
+
+// handle applies one key press. It returns the line once Enter submits it,
+// and the completions when Tab finds several and cannot extend the word.
+func (e *lineEditor) handle(k key) (string, bool, []string) {
+    if k.code == keyTab {
+        return "", false, e.completeWord()
+    }
+
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    switch k.code {
+    case keyRune:
+        e.buf = append(e.buf[:e.cursor], append([]rune{k.r}, e.buf[e.cursor:]...)...)
+        e.cursor++
+    case keyBackspace:
+        if e.cursor > 0 {
+            e.buf = append(e.buf[:e.cursor-1], e.buf[e.cursor:]...)
+            e.cursor--
+        }
+    case keyDelete:
+        if e.cursor < len(e.buf) {
+            e.buf = append(e.buf[:e.cursor], e.buf[e.cursor+1:]...)
+        }
+    case keyLeft:
+        if e.cursor > 0 {
+            e.cursor--
+        }
+    case keyRight:
+        if e.cursor < len(e.buf) {
+            e.cursor++
+        }
+    case keyHome:
+        e.cursor = 0
+    case keyEnd:
+        e.cursor = len(e.buf)
+    case keyKillLine:
+        e.buf = append([]rune(nil), e.buf[e.cursor:]...)
+        e.cursor = 0
+    case keyKillEnd:
+        e.buf = e.buf[:e.cursor]
+    case keyKillWord:
+        start := e.cursor
+        for start > 0 && unicode.IsSpace(e.buf[start-1]) {
+            start--
+        }
+        for start > 0 && !unicode.IsSpace(e.buf[start-1]) {
+            start--
+        }
+        e.buf = append(e.buf[:start], e.buf[e.cursor:]...)
+        e.cursor = start
+    case keyUp:
+        if e.histPos > 0 {
+            if e.histPos == len(e.history) {
+                e.draft = string(e.buf)
+            }
+            e.histPos--
+            e.setLine(e.history[e.histPos])
+        }
+    case keyDown:
+        if e.histPos < len(e.history) {
+            e.histPos++
+            if e.histPos == len(e.history) {
+                e.setLine(e.draft)
+            } else {
+                e.setLine(e.history[e.histPos])
+            }
+        }
+    case keyEnter:
+        line := string(e.buf)
+        e.buf, e.cursor = nil, 0
+        e.addHistory(line)
+        return line, true, nil
+    }
+    return "", false, nil
+}
+
+// setLine replaces the line, with the cursor at its end. Caller must hold mu.
+func (e *lineEditor) setLine(line string) {
+    e.buf = []rune(line)
+    e.cursor = len(e.buf)
+}
+
+// messageCommands carry message text, which is never written to the
+// history file.
+var messageCommands = []string{"send", "alert", "reply", "edit"}
+
+func isMessageCommand(line string) bool {
+    command, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+    return slices.Contains(messageCommands, command)
+}
+
+// composingMessage reports whether input is a message being typed, as
+// opposed to a command, so peers can be told we are typing.
+func composingMessage(input string) bool {
+    for _, command := range messageCommands {
+        if strings.HasPrefix(input, command+" ") && len(input) > len(command)+1 {
+            return true
+        }
+    }
+    return false
+}
+
+// addHistory records a submitted line. Ephemeral messages are left out so
+// they cannot be recalled after they expire, and other messages are only
+// recalled until exit, so no message text is stored on disk.
+// Caller must hold mu.
+func (e *lineEditor) addHistory(line string) {
+    defer func() {
+        e.histPos = len(e.history)
+        e.draft = ""
+    }()
+
+    if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "send --ttl") {
+        return
+    }
+    if n := len(e.history); n > 0 && e.history[n-1] == line {
+        return
+    }
+    e.history = append(e.history, line)
+    if len(e.history) > maxHistoryLines {
+        e.history = e.history[1:]
+    }
+
+    if e.histFile != "" && !isMessageCommand(line) {
+        f, err := os.OpenFile(e.histFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+        if err != nil {
+            return
+        }
+        fmt.Fprintln(f, line)
+        f.Close()
+    }
+}
+
+// completeWord extends the word before the cursor to the longest prefix
+// shared by its completions, adding a space when only one is left. If
+// that does not change the word it returns the completions to list.
+// Completions may look up peers, so they are found without holding mu:
+// code holding the peer table lock may log, which redraws the line.
+func (e *lineEditor) completeWord() []string {
+    if e.complete == nil {
+        return nil
+    }
+    e.mu.Lock()
+    line, cursor := string(e.buf), e.cursor
+    e.mu.Unlock()
+
+    start, candidates := e.complete(line, cursor)
+    if len(candidates) == 0 {
+        return nil
+    }
+
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if string(e.buf) != line || e.cursor != cursor {
+        return nil
+    }
+
+    word := string(e.buf[start:e.cursor])
+    prefix := candidates[0]
+    for _, c := range candidates[1:] {
+        for !strings.HasPrefix(c, prefix) {
+            prefix = prefix[:len(prefix)-1]
+        }
+    }
+    for !utf8.ValidString(prefix) {
+        prefix = prefix[:len(prefix)-1]
+    }
+    if len(candidates) == 1 && !strings.HasSuffix(prefix, "/") {
+        prefix += " "
+    }
+    if prefix == word {
+        return candidates
+    }
+
+    completed := []rune(prefix)
+    e.buf = append(append(append([]rune(nil), e.buf[:start]...), completed...), e.buf[e.cursor:]...)
+    e.cursor = start + len(completed)
+    return nil
+}
+
+// view returns the part of the line that fits in width columns, keeping
+// the cursor in sight, and the cursor column within it.
+func (e *lineEditor) view(width int) (string, int) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    offset := 0
+    if width > 0 && e.cursor >= width {
+        offset = e.cursor - width + 1
+    }
+    end := len(e.buf)
+    if width > 0 && end-offset > width {
+        end = offset + width
+    }
+    return string(e.buf[offset:end]), e.cursor - offset
+}
+
+// line returns the text being edited.
+func (e *lineEditor) line() string {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    return string(e.buf)
+}
+
+// render returns the terminal output redrawing prompt and the line in
+// line mode, with the cursor in place.
+func (e *lineEditor) render(prompt string) string {
+    width := 0
+    if w, _, err := terminalSize(int(os.Stdout.Fd())); err == nil {
+        width = w - len(prompt) - 1
+    }
+    text, cursor := e.view(width)
+    return fmt.Sprintf("\r%s%s%s\r%s", clearLine, prompt, text, moveRight(len(prompt)+cursor))
+}
+
+// readLine edits one line in line mode, on a terminal whose input is in
+// raw mode, and returns it once Enter is pressed. Ctrl-C returns
+// errInterrupted, and Ctrl-D on an empty line io.EOF. onKey is called on
+// every key, after it has been applied to the line.
+func (e *lineEditor) readLine(in *bufio.Reader, prompt string, onKey func(key)) (string, error) {
+    for {
+        k, err := readKey(in)
+        if err != nil {
+            return "", err
+        }
+        if k.code == keyInterrupt {
+            fmt.Println()
+            return "", errInterrupted
+        }
+        if k.code == keyEOF && e.line() == "" {
+            fmt.Println()
+            return "", io.EOF
+        }
+
+        line, submitted, candidates := e.handle(k)
+        onKey(k)
+        if submitted {
+            fmt.Println()
+            return line, nil
+        }
+        if len(candidates) > 0 {
+            fmt.Printf("\n%s\n", strings.Join(candidates, "  "))
+        }
+        fmt.Print(e.render(prompt))
+    }
+}
+
+// moveRight returns the escape sequence moving the cursor n columns right.
+func moveRight(n int) string {
+    if n <= 0 {
+        return ""
+    }
+    return fmt.Sprintf("\033[%dC", n)
+}
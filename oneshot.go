@@ -0,0 +1,209 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+    "os/signal"
+    "strings"
+    "syscall"
+    "time"
+
+    "messenger/core"
+)
+
+// Subcommands run a node just long enough to do one thing, so scripts
+// need not drive the interactive CLI through stdin.
+var subcommandUsage = map[string]string{
+    "send":   "send [--to peer] [--ttl duration] [--timeout duration] <text>",
+    "file":   "file [--to peer] [--timeout duration] <path>",
+    "peers":  "peers [--json] [--timeout duration]",
+    "listen": "listen",
+}
+
+var subcommandOrder = []string{"send", "file", "peers", "listen"}
+
+type subcommand struct {
+    name    string
+    args    []string
+    to      string        // peer ID, ID prefix or nickname, empty for all
+    ttl     time.Duration // for send
+    replyTo string        // for send
+    timeout time.Duration
+    json    bool // for peers
+}
+
+func usage() {
+    out := flag.CommandLine.Output()
+    fmt.Fprintln(out, "usage: messenger [flags]")
+    for _, name := range subcommandOrder {
+        fmt.Fprintf(out, "       messenger [flags] %s\n", subcommandUsage[name])
+    }
+    fmt.Fprintln(out, "\nflags:")
+    flag.PrintDefaults()
+}
+
+// parseSubcommand parses the arguments following the global flags. Its
+// own flags may come before, after or between the positional arguments;
+// everything after "--" is positional.
+func parseSubcommand(args []string) (*subcommand, error) {
+    cmd := &subcommand{name: args[0]}
+    line, ok := subcommandUsage[cmd.name]
+    if !ok {
+        return nil, fmt.Errorf("unknown command %q, expected one of: %s",
+            cmd.name, strings.Join(subcommandOrder, ", "))
+    }
+
+    fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+    fs.Usage = func() {
+        fmt.Fprintf(fs.Output(), "usage: messenger [flags] %s\n", line)
+        fs.PrintDefaults()
+    }
+    switch cmd.name {
+    case "send", "file":
+        fs.StringVar(&cmd.to, "to", "", "Peer ID, ID prefix or nickname to send to (default all peers)")
+        fs.DurationVar(&cmd.timeout, "timeout", 10*time.Second, "Give up finding peers and waiting for delivery after this long")
+        if cmd.name == "send" {
+            fs.DurationVar(&cmd.ttl, "ttl", 0, "Receivers discard the message this long after it arrives")
+        }
+    case "peers":
+        fs.BoolVar(&cmd.json, "json", false, "Print peers as a JSON array")
+        fs.DurationVar(&cmd.timeout, "timeout", 3*time.Second, "How long to listen for peers")
+    }
+
+    args, rest := args[1:], []string(nil)
+    for i, arg := range args {
+        if arg == "--" {
+            args, rest = args[:i], args[i+1:]
+            break
+        }
+    }
+    for {
+        fs.Parse(args)
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        cmd.args = append(cmd.args, args[0])
+        args = args[1:]
+    }
+    cmd.args = append(cmd.args, rest...)
+
+    switch {
+    case cmd.name == "send" && strings.TrimSpace(strings.Join(cmd.args, " ")) == "":
+        return nil, fmt.Errorf("usage: messenger %s", line)
+    case cmd.name == "file" && len(cmd.args) != 1:
+        return nil, fmt.Errorf("usage: messenger %s", line)
+    case (cmd.name == "peers" || cmd.name == "listen") && len(cmd.args) > 0:
+        return nil, fmt.Errorf("usage: messenger %s", line)
+    case cmd.ttl < 0:
+        return nil, fmt.Errorf("invalid TTL %s", cmd.ttl)
+    }
+    if cmd.name == "file" {
+        if _, err := os.Stat(cmd.args[0]); err != nil {
+            return nil, fmt.Errorf("file does not exist: %s", cmd.args[0])
+        }
+    }
+    return cmd, nil
+}
+
+// run executes the subcommand on a started node and returns the exit
+// status: 0 on success, 1 if it failed or not every peer confirmed delivery.
+func (cmd *subcommand) run(m *core.Messenger) int {
+    switch cmd.name {
+    case "send", "file":
+        return cmd.send(m)
+    case "peers":
+        return cmd.peers(m)
+    case "listen":
+        return cmd.listen(m)
+    }
+    return 2
+}
+
+func (cmd *subcommand) send(m *core.Messenger) int {
+    result, err := cmd.deliver(m)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        return 1
+    }
+    return reportDelivery(result)
+}
+
+// deliver sends the text or file of a send or file command, waiting up to
+// the timeout for the peers to be found and to confirm delivery.
+func (cmd *subcommand) deliver(m *core.Messenger) (deliveryEvent, error) {
+    opts := core.SendOptions{To: cmd.to, ReplyTo: cmd.replyTo, TTL: cmd.ttl, Wait: cmd.timeout}
+    var result core.SendResult
+    var err error
+    if cmd.name == "send" {
+        result, err = m.Send(strings.Join(cmd.args, " "), opts)
+    } else {
+        result, err = m.SendFile(cmd.args[0], opts)
+    }
+    if err != nil {
+        return deliveryEvent{}, err
+    }
+
+    var problems []string
+    for _, failure := range result.Failed {
+        if errors.Is(failure.Err, core.ErrNotDelivered) {
+            problems = append(problems, "Not delivered to "+failure.PeerID)
+        } else {
+            problems = append(problems, fmt.Sprintf("Error sending to %s: %v", failure.PeerID, failure.Err))
+        }
+    }
+    return deliveryEvent{
+        eventHeader: header("delivery"),
+        ID:          result.ID,
+        Type:        result.Type,
+        Delivered:   result.Delivered,
+        Recipients:  result.Recipients,
+        Problems:    problems,
+    }, nil
+}
+
+// reportDelivery prints the result of a send or file command and returns
+// the exit status: 1 unless every peer confirmed delivery.
+func reportDelivery(result deliveryEvent) int {
+    for _, problem := range result.Problems {
+        fmt.Fprintln(os.Stderr, problem)
+    }
+    if jsonOutput {
+        emit(result)
+    } else {
+        fmt.Printf("%s %s delivered to %d/%d peers\n",
+            result.Type, result.ID, result.Delivered, result.Recipients)
+    }
+    if result.Delivered < result.Recipients {
+        return 1
+    }
+    return 0
+}
+
+func (cmd *subcommand) peers(m *core.Messenger) int {
+    time.Sleep(cmd.timeout)
+
+    if !cmd.json {
+        listPeers(m)
+        return 0
+    }
+    data, err := json.MarshalIndent(m.Peers(), "", "  ")
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        return 1
+    }
+    fmt.Println(string(data))
+    return 0
+}
+
+// listen prints incoming messages, through notify, until interrupted.
+func (cmd *subcommand) listen(m *core.Messenger) int {
+    interrupt := make(chan os.Signal, 1)
+    signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+    fmt.Fprintf(os.Stderr, "Listening as %s, interrupt to stop\n", m.ID)
+    <-interrupt
+    return 0
+}
@@ -0,0 +1,12 @@
+//go:build linux
+
+package main
+
+import (
+    "syscall"
+)
+
+const (
+    ioctlGetTermios = syscall.TCGETS
+    ioctlSetTermios = syscall.TCSETS
+)
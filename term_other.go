@@ -0,0 +1,31 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package main
+
+import (
+    "fmt"
+    "os"
+)
+
+// The full-screen interface needs a Unix terminal; elsewhere the CLI runs
+// in line mode.
+
+func isTerminal(fd int) bool {
+    return false
+}
+
+func makeRaw(fd int) (func(), error) {
+    return nil, fmt.Errorf("full-screen mode is not supported on this platform")
+}
+
+func makeInputRaw(fd int) (func(), error) {
+    return nil, fmt.Errorf("line editing is not supported on this platform")
+}
+
+func terminalSize(fd int) (int, int, error) {
+    return 0, 0, fmt.Errorf("terminal size is not available on this platform")
+}
+
+func notifyResize(ch chan<- os.Signal) func() {
+    return func() {}
+}
@@ -0,0 +1,83 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+    "os"
+    "os/signal"
+    "syscall"
+    "unsafe"
+)
+
+func ioctl(fd int, request uintptr, arg unsafe.Pointer) error {
+    _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(arg))
+    if errno != 0 {
+        return errno
+    }
+    return nil
+}
+
+// isTerminal reports whether fd is a terminal.
+func isTerminal(fd int) bool {
+    var t syscall.Termios
+    return ioctl(fd, ioctlGetTermios, unsafe.Pointer(&t)) == nil
+}
+
+// makeRaw puts the terminal on fd into raw mode, so keys arrive one at a
+// time without echo or signals, and returns a function restoring it.
+func makeRaw(fd int) (func(), error) {
+    return setRaw(fd, true)
+}
+
+// makeInputRaw is makeRaw for input only: output processing stays on, so
+// text printed with "\n" still starts a new line, and Enter reads as "\n".
+func makeInputRaw(fd int) (func(), error) {
+    return setRaw(fd, false)
+}
+
+func setRaw(fd int, output bool) (func(), error) {
+    var saved syscall.Termios
+    if err := ioctl(fd, ioctlGetTermios, unsafe.Pointer(&saved)); err != nil {
+        return nil, err
+    }
+
+    raw := saved
+    raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+        syscall.INLCR | syscall.IGNCR | syscall.IXON
+    if output {
+        raw.Iflag &^= syscall.ICRNL
+        raw.Oflag &^= syscall.OPOST
+    }
+    raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+    raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+    raw.Cflag |= syscall.CS8
+    raw.Cc[syscall.VMIN] = 1
+    raw.Cc[syscall.VTIME] = 0
+    if err := ioctl(fd, ioctlSetTermios, unsafe.Pointer(&raw)); err != nil {
+        return nil, err
+    }
+
+    return func() {
+        ioctl(fd, ioctlSetTermios, unsafe.Pointer(&saved))
+    }, nil
+}
+
+// terminalSize returns the width and height of the terminal on fd.
+func terminalSize(fd int) (int, int, error) {
+    var ws struct {
+        Row, Col, Xpixel, Ypixel uint16
+    }
+    if err := ioctl(fd, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+        return 0, 0, err
+    }
+    return int(ws.Col), int(ws.Row), nil
+}
+
+// notifyResize delivers a signal on ch whenever the terminal is resized,
+// until the returned function is called.
+func notifyResize(ch chan<- os.Signal) func() {
+    signal.Notify(ch, syscall.SIGWINCH)
+    return func() {
+        signal.Stop(ch)
+    }
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "unicode/utf8"
+
+    "messenger/core"
+)
+
+const (
+    maxPaneLines     = 2000 // lines kept in the message pane for scrolling back
+    sidebarWidth     = 26
+    minSidebarScreen = 60 // narrower terminals hide the peer sidebar
+
+    altScreenOn  = "\033[?1049h"
+    altScreenOff = "\033[?1049l"
+    colorStatus  = "\033[7m" // reverse video
+    colorDim     = "\033[2m"
+)
+
+// paneLine is one line of the message pane.
+type paneLine struct {
+    text  string
+    alert bool
+}
+
+// tui is the full-screen interface: a scrolling message pane, a peer
+// sidebar, a status bar and an input line that output never overwrites.
+type tui struct {
+    mu      sync.Mutex
+    width   int
+    height  int
+    lines   []paneLine
+    partial string   // output written without a trailing newline yet
+    scroll  int      // rows scrolled back from the bottom of the pane
+    peers   []string // sidebar rows
+    status  string
+    editor  *lineEditor // the input line
+}
+
+// screen is the running full-screen interface, nil in line mode.
+var screen atomic.Pointer[tui]
+
+// Write adds command or log output to the message pane.
+func (t *tui) Write(p []byte) (int, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    text := t.partial + stripEscapes(string(p))
+    lines := strings.Split(text, "\n")
+    t.partial = lines[len(lines)-1]
+    for _, line := range lines[:len(lines)-1] {
+        t.appendLine(line, false)
+    }
+    t.draw()
+    return len(p), nil
+}
+
+// addLine shows text, which may span several lines, in the message pane.
+func (t *tui) addLine(text string, alert bool) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    for _, line := range strings.Split(stripEscapes(text), "\n") {
+        t.appendLine(line, alert)
+    }
+    if alert {
+        os.Stdout.WriteString(bell)
+    }
+    t.draw()
+}
+
+// appendLine adds one line to the pane. Caller must hold mu.
+func (t *tui) appendLine(line string, alert bool) {
+    line = strings.ReplaceAll(strings.TrimRight(line, "\r"), "\t", "    ")
+    t.lines = append(t.lines, paneLine{text: line, alert: alert})
+    if len(t.lines) > maxPaneLines {
+        t.lines = t.lines[len(t.lines)-maxPaneLines:]
+    }
+}
+
+// clear empties the message pane.
+func (t *tui) clear() {
+    t.mu.Lock()
+    t.lines, t.partial, t.scroll = nil, "", 0
+    t.draw()
+    t.mu.Unlock()
+}
+
+// update replaces the status bar and sidebar contents.
+func (t *tui) update(status string, peers []string) {
+    t.mu.Lock()
+    t.status, t.peers = status, peers
+    t.draw()
+    t.mu.Unlock()
+}
+
+// paneSize returns the size of the message pane and whether the sidebar
+// is shown. Caller must hold mu.
+func (t *tui) paneSize() (int, int, bool) {
+    width, sidebar := t.width, t.width >= minSidebarScreen
+    if sidebar {
+        width -= sidebarWidth + 1
+    }
+    return width, t.height - 2, sidebar
+}
+
+// draw repaints the whole screen. Caller must hold mu.
+func (t *tui) draw() {
+    paneWidth, paneHeight, sidebar := t.paneSize()
+    if paneWidth < 10 || paneHeight < 1 {
+        return
+    }
+
+    var b strings.Builder
+    rows := t.paneRows(paneWidth, paneHeight)
+    for i, row := range rows {
+        fmt.Fprintf(&b, "\033[%d;1H", i+1)
+        if row.alert {
+            b.WriteString(colorAlert + pad(row.text, paneWidth) + colorReset)
+        } else {
+            b.WriteString(pad(row.text, paneWidth))
+        }
+        if sidebar {
+            side := ""
+            if i < len(t.peers) {
+                side = " " + t.peers[i]
+            }
+            b.WriteString(colorDim + "│" + colorReset + pad(side, sidebarWidth))
+        }
+    }
+
+    status := t.status
+    if t.scroll > 0 {
+        status = fmt.Sprintf("[scrolled back %d, PgDn to return] %s", t.scroll, status)
+    }
+    fmt.Fprintf(&b, "\033[%d;1H%s%s%s", t.height-1, colorStatus, pad(status, t.width), colorReset)
+
+    const prompt = "> "
+    input, cursor := t.editor.view(t.width - len(prompt) - 1)
+    fmt.Fprintf(&b, "\033[%d;1H%s%s\033[K\033[%d;%dH",
+        t.height, prompt, input, t.height, len(prompt)+cursor+1)
+    os.Stdout.WriteString(b.String())
+}
+
+// paneRows wraps the pane lines to width and returns the height rows in
+// view, bottom-aligned. Caller must hold mu.
+func (t *tui) paneRows(width, height int) []paneLine {
+    // Collect wrapped rows from the bottom up, only as many as needed
+    var rows []paneLine
+    for i := len(t.lines) - 1; i >= 0 && len(rows) < height+t.scroll; i-- {
+        wrapped := wrap(t.lines[i].text, width)
+        for j := len(wrapped) - 1; j >= 0; j-- {
+            rows = append(rows, paneLine{text: wrapped[j], alert: t.lines[i].alert})
+        }
+    }
+    if t.scroll > len(rows)-height {
+        t.scroll = max(0, len(rows)-height)
+    }
+
+    view := make([]paneLine, height)
+    for i := 0; i < height && t.scroll+i < len(rows); i++ {
+        view[height-1-i] = rows[t.scroll+i]
+    }
+    return view
+}
+
+func wrap(s string, width int) []string {
+    r := []rune(s)
+    if len(r) <= width {
+        return []string{s}
+    }
+    var rows []string
+    for len(r) > width {
+        rows = append(rows, string(r[:width]))
+        r = r[width:]
+    }
+    return append(rows, string(r))
+}
+
+// pad truncates or space-fills s to exactly width columns.
+func pad(s string, width int) string {
+    r := []rune(s)
+    if len(r) > width {
+        return string(r[:width])
+    }
+    return s + strings.Repeat(" ", width-len(r))
+}
+
+// stripEscapes removes terminal control sequences from output meant for
+// the line-mode terminal, so they cannot corrupt the layout: CSI
+// sequences, OSC, DCS and other control strings, two-byte escapes, in
+// their 7-bit and 8-bit (C1) forms, and every other control character but
+// tab and newline.
+func stripEscapes(s string) string {
+    if strings.IndexFunc(s, isControlRune) < 0 && utf8.ValidString(s) {
+        return s
+    }
+    var b strings.Builder
+    for i := 0; i < len(s); {
+        r, size := utf8.DecodeRuneInString(s[i:])
+        switch {
+        case r == '\033' && i+1 < len(s):
+            i = skipEscape(s, i+1)
+        case r == 0x9b: // CSI
+            i = skipCSI(s, i+size)
+        case r == 0x90 || r == 0x98 || r == 0x9d || r == 0x9e || r == 0x9f: // DCS, SOS, OSC, PM, APC
+            i = skipControlString(s, i+size)
+        case isControlRune(r) || (r == utf8.RuneError && size == 1):
+            i += size
+        default:
+            b.WriteString(s[i : i+size])
+            i += size
+        }
+    }
+    return b.String()
+}
+
+// isControlRune reports whether r is a C0 control other than tab and
+// newline, DEL or a C1 control.
+func isControlRune(r rune) bool {
+    return (r < 0x20 && r != '\t' && r != '\n') || (r >= 0x7f && r <= 0x9f)
+}
+
+// skipEscape returns the offset after the escape sequence whose ESC ends
+// just before i. An ESC not starting a sequence is dropped on its own.
+func skipEscape(s string, i int) int {
+    switch c := s[i]; {
+    case c == '[':
+        return skipCSI(s, i+1)
+    case c == ']' || c == 'P' || c == 'X' || c == '^' || c == '_':
+        return skipControlString(s, i+1)
+    case c >= 0x20 && c <= 0x2f: // intermediate bytes, then a final byte
+        for i < len(s) && s[i] >= 0x20 && s[i] <= 0x2f {
+            i++
+        }
+        if i < len(s) && s[i] >= 0x30 && s[i] <= 0x7e {
+            i++
+        }
+        return i
+    case c >= 0x30 && c <= 0x7e:
+        return i + 1
+    }
+    return i
+}
+
+// skipCSI returns the offset after the final byte of a CSI sequence whose
+// parameters start at i.
+func skipCSI(s string, i int) int {
+    for i < len(s) && (s[i] < 0x40 || s[i] > 0x7e) {
+        i++
+    }
+    return min(i+1, len(s))
+}
+
+// skipControlString returns the offset after the string terminator (ESC \,
+// BEL or ST) of a control string starting at i, or the end of s.
+func skipControlString(s string, i int) int {
+    for i < len(s) {
+        switch {
+        case s[i] == '\a':
+            return i + 1
+        case s[i] == '\033' && i+1 < len(s) && s[i+1] == '\\':
+            return i + 2
+        case strings.HasPrefix(s[i:], "\u009c"):
+            return i + len("\u009c")
+        }
+        i++
+    }
+    return i
+}
+
+// sidebarPeers lists peers for the sidebar: active peers are marked ●,
+// others ○, with their status if not available and ✎ while typing.
+func sidebarPeers(m *core.Messenger) []string {
+    typing := make(map[string]bool)
+    for _, id := range m.TypingPeers() {
+        typing[id] = true
+    }
+
+    var rows []string
+    for _, addr := range m.PendingPeers() {
+        rows = append(rows, "○ "+addr)
+    }
+    for _, peer := range m.Peers() {
+        name := peer.ID
+        if peer.Nickname != "" {
+            name = peer.Nickname
+        }
+        row := "○ " + name
+        if peer.Active {
+            row = "● " + name
+        }
+        if peer.Presence != "" && peer.Presence != core.PresenceAvailable {
+            row += " " + peer.Presence
+        }
+        if typing[peer.ID] {
+            row += " ✎"
+        }
+        rows = append(rows, row)
+    }
+    sort.Slice(rows, func(i, j int) bool { return rows[i][len("● "):] < rows[j][len("● "):] })
+    return append([]string{fmt.Sprintf("Peers (%d)", len(rows)), ""}, rows...)
+}
+
+// Keys the full-screen interface reacts to
+type keyCode int
+
+const (
+    keyRune keyCode = iota
+    keyEnter
+    keyBackspace
+    keyInterrupt // Ctrl-C
+    keyEOF       // Ctrl-D
+    keyPageUp
+    keyPageDown
+    keyUp
+    keyDown
+    keyLeft
+    keyRight
+    keyHome
+    keyEnd
+    keyDelete
+    keyTab
+    keyKillLine // Ctrl-U, delete to the start of the line
+    keyKillEnd  // Ctrl-K, delete to the end of the line
+    keyKillWord // Ctrl-W, delete the word before the cursor
+    keyUnknown
+)
+
+// Control characters with an editing meaning
+var controlKeys = map[rune]keyCode{
+    1:  keyHome,  // Ctrl-A
+    2:  keyLeft,  // Ctrl-B
+    3:  keyInterrupt,
+    4:  keyEOF,
+    5:  keyEnd,   // Ctrl-E
+    6:  keyRight, // Ctrl-F
+    9:  keyTab,
+    11: keyKillEnd,
+    14: keyDown, // Ctrl-N
+    16: keyUp,   // Ctrl-P
+    21: keyKillLine,
+    23: keyKillWord,
+}
+
+// Control sequences sent for navigation keys, after ESC [ or ESC O
+var escapeKeys = map[string]keyCode{
+    "A":  keyUp,
+    "B":  keyDown,
+    "C":  keyRight,
+    "D":  keyLeft,
+    "H":  keyHome,
+    "F":  keyEnd,
+    "1~": keyHome,
+    "7~": keyHome,
+    "4~": keyEnd,
+    "8~": keyEnd,
+    "3~": keyDelete,
+    "5~": keyPageUp,
+    "6~": keyPageDown,
+}
+
+type key struct {
+    code keyCode
+    r    rune
+}
+
+// readKey reads one key press from a terminal in raw mode.
+func readKey(in *bufio.Reader) (key, error) {
+    r, _, err := in.ReadRune()
+    if err != nil {
+        return key{}, err
+    }
+    switch r {
+    case '\r', '\n':
+        return key{code: keyEnter}, nil
+    case 127, '\b':
+        return key{code: keyBackspace}, nil
+    case 27:
+        return readEscape(in)
+    }
+    if r < 32 {
+        if code, ok := controlKeys[r]; ok {
+            return key{code: code}, nil
+        }
+        return key{code: keyUnknown}, nil
+    }
+    return key{code: keyRune, r: r}, nil
+}
+
+// readEscape decodes the control sequence following ESC that terminals
+// send for navigation keys. A lone ESC or an unused sequence is unknown.
+func readEscape(in *bufio.Reader) (key, error) {
+    if in.Buffered() == 0 {
+        return key{code: keyUnknown}, nil
+    }
+    b, err := in.ReadByte()
+    if err != nil {
+        return key{}, err
+    }
+    if b != '[' && b != 'O' {
+        return key{code: keyUnknown}, nil
+    }
+
+    var seq []byte
+    for {
+        c, err := in.ReadByte()
+        if err != nil {
+            return key{}, err
+        }
+        seq = append(seq, c)
+        if c >= 0x40 && c <= 0x7e {
+            break
+        }
+    }
+    if code, ok := escapeKeys[string(seq)]; ok {
+        return key{code: code}, nil
+    }
+    return key{code: keyUnknown}, nil
+}
+
+// runTUI runs the full-screen interface, reading commands with editor,
+// until the user quits. If the terminal cannot be used it returns an error
+// before touching the screen, so the caller can fall back to line mode.
+// onInput is called on every key.
+func runTUI(messenger *core.Messenger, editor *lineEditor, onInput func()) error {
+    restore, err := makeRaw(int(os.Stdin.Fd()))
+    if err != nil {
+        return err
+    }
+    width, height, err := terminalSize(int(os.Stdout.Fd()))
+    if err != nil {
+        restore()
+        return err
+    }
+
+    t := &tui{width: width, height: height, status: getStatusLine(messenger), editor: editor}
+    os.Stdout.WriteString(altScreenOn)
+    screen.Store(t)
+    out.set(t)
+    log.SetOutput(t)
+    done := make(chan struct{})
+    defer func() {
+        close(done)
+        screen.Store(nil)
+        out.set(os.Stdout)
+        log.SetOutput(os.Stderr)
+        os.Stdout.WriteString(altScreenOff)
+        restore()
+    }()
+
+    t.addLine(fmt.Sprintf("NAFO Radio Local Network Messenger v%s - your ID: %s", core.Version, messenger.ID), false)
+    t.addLine("Type 'help' for commands. Tab completes, Up/Down recall history, "+
+        "PgUp/PgDn scroll, Ctrl-C quits.", false)
+    t.update(getStatusLine(messenger), sidebarPeers(messenger))
+
+    // Follow terminal size changes
+    resize := make(chan os.Signal, 1)
+    stopResize := notifyResize(resize)
+    defer stopResize()
+    go func() {
+        for {
+            select {
+            case <-done:
+                return
+            case <-resize:
+                if w, h, err := terminalSize(int(os.Stdout.Fd())); err == nil {
+                    t.mu.Lock()
+                    t.width, t.height = w, h
+                    t.draw()
+                    t.mu.Unlock()
+                }
+            }
+        }
+    }()
+
+    // Keep the status bar and sidebar current
+    go func() {
+        ticker := time.NewTicker(time.Second)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+            case <-statusChanged:
+            }
+            t.update(getStatusLine(messenger), sidebarPeers(messenger))
+        }
+    }()
+
+    in := bufio.NewReader(os.Stdin)
+    for {
+        k, err := readKey(in)
+        if err != nil {
+            return nil
+        }
+        onInput()
+
+        switch k.code {
+        case keyInterrupt:
+            return nil
+        case keyEOF:
+            if editor.line() == "" {
+                return nil
+            }
+            continue
+        case keyPageUp, keyPageDown:
+            t.mu.Lock()
+            _, paneHeight, _ := t.paneSize()
+            if k.code == keyPageUp {
+                t.scroll += paneHeight / 2
+            } else {
+                t.scroll = max(0, t.scroll-paneHeight/2)
+            }
+            t.draw()
+            t.mu.Unlock()
+            continue
+        }
+
+        // Not under t.mu: completing peer names takes the peer table lock,
+        // which is held while logging to the pane
+        line, submitted, candidates := editor.handle(k)
+        t.mu.Lock()
+        if submitted {
+            t.scroll = 0
+        }
+        t.draw()
+        t.mu.Unlock()
+
+        if len(candidates) > 0 {
+            t.addLine(strings.Join(candidates, "  "), false)
+        }
+        if k.code == keyRune && composingMessage(editor.line()) {
+            messenger.NotifyTyping()
+        }
+        if !submitted || line == "" {
+            continue
+        }
+
+        // Anything shown before the user pressed Enter has been seen
+        messenger.MarkAllRead()
+        t.addLine("> "+line, false)
+        if err := validateCommand(line); err != nil {
+            fmt.Fprintf(out, "Error: %v\n", err)
+            continue
+        }
+        if !runCommand(messenger, line) {
+            return nil
+        }
+    }
+}
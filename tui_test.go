@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestStripEscapes(t *testing.T) {
+    tests := []struct {
+        name, in, want string
+    }{
+        {"plain", "hello, world", "hello, world"},
+        {"unicode", "héllo ✓ – 日本", "héllo ✓ – 日本"},
+        {"tab and newline kept", "a\tb\nc", "a\tb\nc"},
+        {"colors", "a\033[31mred\033[0m b", "ared b"},
+        {"cursor movement", "x\033[2J\033[H\033[10;20fy", "xy"},
+        {"private mode", "x\033[?1049hy", "xy"},
+        {"OSC title ended by BEL", "x\033]0;pwned\ay", "xy"},
+        {"OSC hyperlink ended by ST", "x\033]8;;http://e\033\\link\033]8;;\033\\y", "xlinky"},
+        {"unterminated OSC", "x\033]0;title", "x"},
+        {"DCS", "p\033Pq#0;2\033\\q", "pq"},
+        {"APC, PM and SOS", "a\033_x\033\\b\033^y\033\\c\033Xz\033\\d", "abcd"},
+        {"two-byte escape", "e\033cx", "ex"},
+        {"charset designation", "g\033(0h\033(Bi", "ghi"},
+        {"lone ESC at end", "lone\033", "lone"},
+        {"ESC before ESC", "\033\033[1mb", "b"},
+        {"8-bit CSI", "c\u009b2Jx", "cx"},
+        {"8-bit OSC ended by ST", "c\u009d0;t\u009cy", "cy"},
+        {"8-bit OSC ended by BEL", "c\u009d0;t\ay", "cy"},
+        {"other C1", "a\u0085b\u008dc", "abc"},
+        {"invalid UTF-8", "bad\x9b2J", "bad2J"},
+        {"BEL", "ring\a\a", "ring"},
+        {"backspace", "secret\b\b\b\b\b\bpublic", "secretpublic"},
+        {"carriage return", "line\rover", "lineover"},
+        {"CRLF", "line\r\n", "line\n"},
+        {"shift out and in", "a\x0eqqq\x0fb", "aqqqb"},
+        {"NUL", "a\x00b", "ab"},
+        {"DEL", "a\x7fb", "ab"},
+        {"form feed and vertical tab", "a\fb\vc", "abc"},
+    }
+
+    for _, test := range tests {
+        if got := stripEscapes(test.in); got != test.want {
+            t.Errorf("%s: stripEscapes(%q) = %q, want %q", test.name, test.in, got, test.want)
+        }
+    }
+}